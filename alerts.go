@@ -0,0 +1,608 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the threshold alerts. Rules (from the config or added through the API) are evaluated periodically
+// and when one starts or stops firing, an event is POSTed as signed JSON to the webhooks.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How many events are kept in the history
+	alertEventHistory = 100
+	// Webhook deliveries are attempted this many times, backing off (1s, 2s, 4s...) between attempts
+	alertDeliveryAttempts = 4
+)
+
+// Field and network names end up in the SQL, so rules are held to a stricter standard than SanitizeCommonQueryParams
+var alertNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// The current state of a rule
+type AlertStatus struct {
+	Rule          AlertRule `json:"rule"`
+	Firing        bool      `json:"firing"`
+	Since         time.Time `json:"since"`
+	Value         float64   `json:"value"`
+	Count         int       `json:"count"`
+	LastEvaluated time.Time `json:"lastEvaluated"`
+	Error         string    `json:"error,omitempty"`
+	// Identifies the current firing episode, the resolved event carries the same id so receivers can pair them up
+	episode string
+}
+
+// What gets sent to the webhooks. The id is the same for every delivery attempt of an event so receivers can deduplicate.
+type AlertEvent struct {
+	Id         string          `json:"id"`
+	Episode    string          `json:"episode"`
+	State      string          `json:"state"`
+	Rule       AlertRule       `json:"rule"`
+	Value      float64         `json:"value"`
+	Count      int             `json:"count"`
+	WindowFrom string          `json:"windowFrom"`
+	WindowTo   string          `json:"windowTo"`
+	Time       time.Time       `json:"time"`
+	Deliveries []AlertDelivery `json:"deliveries,omitempty"`
+}
+
+type AlertDelivery struct {
+	Url       string `json:"url"`
+	Attempts  int    `json:"attempts"`
+	Status    int    `json:"status"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+type AlertManager struct {
+	conf     AlertsConf
+	interval time.Duration
+	client   *http.Client
+	mu       sync.RWMutex
+	rules    map[string]*AlertStatus
+	events   []AlertEvent
+	stop     chan struct{}
+	// The wait before the first retry of a delivery (doubled after each attempt)
+	backoff time.Duration
+}
+
+var alerts *AlertManager
+
+func newAlertManager(conf AlertsConf) (*AlertManager, error) {
+	m := &AlertManager{
+		conf:     conf,
+		interval: time.Minute,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		rules:    map[string]*AlertStatus{},
+		events:   []AlertEvent{},
+		stop:     make(chan struct{}),
+		backoff:  time.Second,
+	}
+	if conf.Interval != "" {
+		interval, err := time.ParseDuration(conf.Interval)
+		if err != nil || interval < time.Second {
+			return nil, errors.New("invalid alerts interval: " + conf.Interval)
+		}
+		m.interval = interval
+	}
+	for _, rule := range conf.Rules {
+		if err := m.AddRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Checks a rule and fills in the defaults
+func validateAlertRule(rule AlertRule) (AlertRule, error) {
+	if rule.Name == "" || rule.Territory == "" {
+		return rule, errors.New("alert rules need a name and a territory")
+	}
+	if rule.Series == "" {
+		rule.Series = "messages"
+	}
+	if SanitizeCommonQueryParams(CommonQueryParams{Series: rule.Series}).Series == "" {
+		return rule, errors.New("unknown series: " + rule.Series)
+	}
+	if rule.Network != "" && !alertNamePattern.MatchString(rule.Network) {
+		return rule, errors.New("invalid network: " + rule.Network)
+	}
+	if rule.Field != "" && !alertNamePattern.MatchString(rule.Field) {
+		return rule, errors.New("invalid field: " + rule.Field)
+	}
+	switch rule.Kind {
+	case "count", "change":
+		if rule.Field != "" && rule.Value == "" {
+			return rule, errors.New("a value is required when counting by field")
+		}
+	case "share":
+		if rule.Field == "" || rule.Value == "" {
+			return rule, errors.New("share rules need a field and a value")
+		}
+	default:
+		return rule, errors.New("alert kind must be count, change or share")
+	}
+	if rule.Window == "" {
+		rule.Window = "1h"
+	}
+	if window, err := time.ParseDuration(rule.Window); err != nil || window < time.Minute {
+		return rule, errors.New("invalid window (a duration of at least 1m): " + rule.Window)
+	}
+	if rule.Above == nil && rule.Below == nil {
+		return rule, errors.New("alert rules need an above and/or below threshold")
+	}
+	for _, webhook := range rule.Webhooks {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return rule, errors.New("webhooks must be absolute http or https URLs: " + webhook)
+		}
+	}
+	return rule, nil
+}
+
+func (m *AlertManager) AddRule(rule AlertRule) error {
+	rule, err := validateAlertRule(rule)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[rule.Name]; ok {
+		return errAlertExists
+	}
+	m.rules[rule.Name] = &AlertStatus{Rule: rule}
+	return nil
+}
+
+var errAlertExists = errors.New("an alert rule with that name already exists")
+
+// Returns the rule with the given name, false if there isn't one
+func (m *AlertManager) Rule(name string) (AlertRule, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status, ok := m.rules[name]
+	if !ok {
+		return AlertRule{}, false
+	}
+	return status.Rule, true
+}
+
+// Removes a rule, returning whether or not it existed. Rules from the config come back on restart.
+func (m *AlertManager) RemoveRule(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.rules[name]
+	delete(m.rules, name)
+	return ok
+}
+
+func (m *AlertManager) Start() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.Evaluate(time.Now().UTC())
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *AlertManager) Stop() {
+	close(m.stop)
+}
+
+// Evaluates every rule as of the given time, sending events for any that started or stopped firing
+func (m *AlertManager) Evaluate(now time.Time) {
+	m.mu.RLock()
+	rules := make([]AlertRule, 0, len(m.rules))
+	for _, status := range m.rules {
+		rules = append(rules, status.Rule)
+	}
+	m.mu.RUnlock()
+
+	for _, rule := range rules {
+		value, count, ok, err := evaluateAlertRule(rule, now)
+		window, _ := time.ParseDuration(rule.Window)
+
+		m.mu.Lock()
+		status, exists := m.rules[rule.Name]
+		if !exists {
+			// Removed while evaluating
+			m.mu.Unlock()
+			continue
+		}
+		status.LastEvaluated = now
+		status.Error = ""
+		if err != nil {
+			status.Error = err.Error()
+			m.mu.Unlock()
+			continue
+		}
+		status.Value = value
+		status.Count = count
+
+		// Not enough to go on (ie. nothing in the previous window to compare against), leave the state as it is
+		firing := status.Firing
+		if ok {
+			firing = alertThresholdCrossed(rule, value)
+		}
+
+		var event *AlertEvent
+		if firing != status.Firing {
+			status.Firing = firing
+			status.Since = now
+			state := "resolved"
+			if firing {
+				state = "firing"
+				status.episode = alertEventId(rule.Name, "episode", now)
+			}
+			event = &AlertEvent{
+				Id:         alertEventId(rule.Name, state, now),
+				Episode:    status.episode,
+				State:      state,
+				Rule:       rule,
+				Value:      value,
+				Count:      count,
+				WindowFrom: now.Add(-window).Format("2006-01-02 15:04:05"),
+				WindowTo:   now.Format("2006-01-02 15:04:05"),
+				Time:       now,
+			}
+			m.events = append(m.events, *event)
+			if len(m.events) > alertEventHistory {
+				m.events = m.events[len(m.events)-alertEventHistory:]
+			}
+		}
+		m.mu.Unlock()
+
+		if event != nil {
+			log.Println("Alert " + rule.Name + " " + event.State + " (" + strconv.FormatFloat(value, 'f', -1, 64) + ")")
+			go m.deliver(*event)
+		}
+	}
+}
+
+// Returns the value to compare against the thresholds, the count in the window and whether or not there was enough data
+func evaluateAlertRule(rule AlertRule, now time.Time) (float64, int, bool, error) {
+	if db.Postgres == nil {
+		return 0, 0, false, errors.New("alerts need a Postgres database")
+	}
+	window, _ := time.ParseDuration(rule.Window)
+	params := CommonQueryParams{
+		Territory: rule.Territory,
+		Series:    rule.Series,
+		Network:   rule.Network,
+		Field:     rule.Field,
+		From:      now.Add(-window).Format("2006-01-02 15:04:05"),
+		To:        now.Format("2006-01-02 15:04:05"),
+	}
+
+	switch rule.Kind {
+	case "count":
+		// A failed query is an error, not a count of 0 (which could fire a "below" rule)
+		result, err := db.CountE(params, rule.Value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		return float64(result.Count), result.Count, true, nil
+	case "change":
+		result, err := db.CountE(params, rule.Value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		count := result.Count
+		previousParams := params
+		previousParams.From = now.Add(-2 * window).Format("2006-01-02 15:04:05")
+		previousParams.To = now.Add(-window).Format("2006-01-02 15:04:05")
+		previousResult, err := db.CountE(previousParams, rule.Value)
+		if err != nil {
+			return 0, count, false, err
+		}
+		previous := previousResult.Count
+		if previous == 0 || count < rule.MinCount {
+			return 0, count, false, nil
+		}
+		return float64(count) / float64(previous), count, true, nil
+	case "share":
+		// Two counts, the matching records and all of them, so it works for any column (ie. sentiment = -1) and a failed
+		// query can't pass for a share of 0
+		matched, err := db.CountE(params, rule.Value)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		totalParams := params
+		totalParams.Field = ""
+		total, err := db.CountE(totalParams, "")
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if total.Count == 0 || total.Count < rule.MinCount {
+			return 0, total.Count, false, nil
+		}
+		return float64(matched.Count) / float64(total.Count), total.Count, true, nil
+	}
+	return 0, 0, false, errors.New("unknown alert kind: " + rule.Kind)
+}
+
+func alertThresholdCrossed(rule AlertRule, value float64) bool {
+	if rule.Above != nil && value > *rule.Above {
+		return true
+	}
+	if rule.Below != nil && value < *rule.Below {
+		return true
+	}
+	return false
+}
+
+func alertEventId(name string, state string, t time.Time) string {
+	sum := sha256.Sum256([]byte(name + "|" + state + "|" + t.Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Signs the payload for the webhook receivers: hex(HMAC-SHA256(secret, timestamp + "." + body))
+func signAlertPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// POSTs the event to each webhook, retrying failed deliveries (5xx, 429 and connection errors) with a backoff
+func (m *AlertManager) deliver(event AlertEvent) {
+	urls := append([]string{}, m.conf.Webhooks...)
+	for _, u := range event.Rule.Webhooks {
+		duplicate := false
+		for _, existing := range urls {
+			if existing == u {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	deliveries := make([]AlertDelivery, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			deliveries[i] = m.post(u, event, body)
+		}(i, u)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	for i := range m.events {
+		if m.events[i].Id == event.Id {
+			m.events[i].Deliveries = deliveries
+		}
+	}
+	m.mu.Unlock()
+}
+
+func (m *AlertManager) post(url string, event AlertEvent, body []byte) AlertDelivery {
+	delivery := AlertDelivery{Url: url}
+	wait := m.backoff
+	for delivery.Attempts < alertDeliveryAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		delivery.Attempts++
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			delivery.Error = err.Error()
+			break
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "SocialHarvest-Reporter")
+		req.Header.Set("X-SocialHarvest-Event", event.Id)
+		req.Header.Set("X-SocialHarvest-Timestamp", timestamp)
+		if m.conf.Secret != "" {
+			req.Header.Set("X-SocialHarvest-Signature", "sha256="+signAlertPayload(m.conf.Secret, timestamp, body))
+		}
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			delivery.Error = err.Error()
+			continue
+		}
+		resp.Body.Close()
+		delivery.Status = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			delivery.Delivered = true
+			delivery.Error = ""
+			return delivery
+		}
+		delivery.Error = "webhook returned status " + strconv.Itoa(resp.StatusCode)
+		// Anything else the receiver didn't like isn't going to get better by trying again
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+	}
+	log.Println("Alert webhook delivery to " + url + " failed: " + delivery.Error)
+	return delivery
+}
+
+// Returns the rules and their current state, sorted by name
+func (m *AlertManager) Rules() []AlertStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := make([]AlertStatus, 0, len(m.rules))
+	for _, status := range m.rules {
+		rules = append(rules, *status)
+	}
+	sort.Sort(alertStatusByName(rules))
+	return rules
+}
+
+// Returns the event history (most recent first)
+func (m *AlertManager) Events() []AlertEvent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := make([]AlertEvent, len(m.events))
+	for i, event := range m.events {
+		events[len(m.events)-1-i] = event
+	}
+	return events
+}
+
+type alertStatusByName []AlertStatus
+
+func (a alertStatusByName) Len() int           { return len(a) }
+func (a alertStatusByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertStatusByName) Less(i, j int) bool { return a[i].Rule.Name < a[j].Rule.Name }
+
+// --------- API end points ---------
+
+// Returns the alert rules and whether or not they're firing
+func AlertRules(w rest.ResponseWriter, r *rest.Request) {
+	res := setAlertLinks("alerts:rules")
+	rules := []AlertStatus{}
+	if alerts != nil {
+		// Only the rules for territories the key is allowed
+		p := requestPrincipal(r)
+		for _, status := range alerts.Rules() {
+			if p == nil || p.hasTerritory(status.Rule.Territory) {
+				rules = append(rules, status)
+			}
+		}
+	}
+	res.Data["rules"] = rules
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// Adds an alert rule (JSON in the request body). Rules added this way last until the reporter is restarted.
+func AlertRuleCreate(w rest.ResponseWriter, r *rest.Request) {
+	if alerts == nil {
+		rest.Error(w, "Alerts are not enabled", http.StatusNotImplemented)
+		return
+	}
+	rule := AlertRule{}
+	if err := r.DecodeJsonPayload(&rule); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Webhooks would otherwise tell the key about a territory it isn't allowed
+	if err := authorize(requestPrincipal(r), scopeAlerts, "", []string{rule.Territory}); err != nil {
+		rest.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// The server signs and sends whatever goes to a webhook, so where they go is only up to the configuration file
+	if len(rule.Webhooks) > 0 {
+		rest.Error(w, "Webhooks can only be set in the configuration file, rules added here use the configured ones", http.StatusBadRequest)
+		return
+	}
+	if err := alerts.AddRule(rule); err != nil {
+		if err == errAlertExists {
+			rest.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	res := setAlertLinks("alerts:rules")
+	for _, status := range alerts.Rules() {
+		if status.Rule.Name == rule.Name {
+			res.Data["rule"] = status
+		}
+	}
+	res.Success()
+	w.WriteHeader(http.StatusCreated)
+	w.WriteJson(res.End())
+}
+
+func AlertRuleDelete(w rest.ResponseWriter, r *rest.Request) {
+	if alerts == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	// Rules for territories the key isn't allowed aren't there as far as it's concerned
+	p := requestPrincipal(r)
+	rule, ok := alerts.Rule(r.PathParam("name"))
+	if !ok || (p != nil && !p.hasTerritory(rule.Territory)) || !alerts.RemoveRule(rule.Name) {
+		rest.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the recent firing and resolved events along with how their webhook deliveries went
+func AlertEvents(w rest.ResponseWriter, r *rest.Request) {
+	res := setAlertLinks("alerts:events")
+	events := []AlertEvent{}
+	if alerts != nil {
+		p := requestPrincipal(r)
+		for _, event := range alerts.Events() {
+			if p == nil || p.hasTerritory(event.Rule.Territory) {
+				events = append(events, event)
+			}
+		}
+	}
+	res.Data["events"] = events
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+func setAlertLinks(self string) *config.HypermediaResource {
+	res := config.NewHypermediaResource()
+	links := map[string]config.HypermediaLink{
+		"alerts:rules":  {Href: "/alerts"},
+		"alerts:rule":   {Href: "/alerts/{name}"},
+		"alerts:events": {Href: "/alerts/events"},
+	}
+	for link, l := range links {
+		if link == self {
+			res.Links["self"] = l
+		} else {
+			res.Links[link] = l
+		}
+	}
+	return res
+}
@@ -0,0 +1,466 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the audit log: who pulled which data. Every API request is recorded with the key (or token) it was made
+// with, the route, territory and params, how many rows were returned and how long it took. Entries are written in the
+// background to a rotating JSON lines file and/or a Postgres table (see AuditConf) and can be searched at /admin/audit.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How many entries can be waiting to be written before new ones are dropped (requests are never held up by the audit log)
+const auditQueueSize = 1000
+
+// The most entries returned by /admin/audit at once
+const maxAuditLimit = 1000
+
+// Where handlers leave how many rows they returned (see setAuditRows)
+const auditRowsEnvKey = "auditRows"
+
+// Params that are never recorded
+var auditSecretParams = []string{"apiKey", "access_token"}
+
+var auditTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A request in the audit log
+type AuditEntry struct {
+	Time      time.Time `json:"time" db:"time"`
+	KeyId     string    `json:"keyId" db:"key_id"`
+	Method    string    `json:"method" db:"method"`
+	Route     string    `json:"route" db:"route"`
+	Group     string    `json:"group" db:"route_group"`
+	Territory string    `json:"territory" db:"territory"`
+	Params    string    `json:"params" db:"params"`
+	Status    int       `json:"status" db:"status"`
+	// Null when the route doesn't say how many it returned
+	Rows      *int    `json:"rows" db:"rows"`
+	LatencyMs float64 `json:"latencyMs" db:"latency_ms"`
+	Bytes     int64   `json:"bytes" db:"bytes"`
+	Ip        string  `json:"ip" db:"ip"`
+}
+
+// Writes entries to the file and/or table in the background
+type auditLog struct {
+	conf     AuditConf
+	maxSize  int64
+	maxFiles int
+	entries  chan AuditEntry
+	done     chan struct{}
+
+	// Only used by the writer
+	file *os.File
+	size int64
+
+	// Guards the file while it's being rotated or searched
+	mu      sync.Mutex
+	dropped int
+}
+
+// The audit log, nil when it isn't configured
+var audit *auditLog
+
+// Whether requests are being audited (so routes know whether it's worth counting rows)
+func auditing() bool {
+	return audit != nil
+}
+
+// Records how many rows the route returned
+func setAuditRows(r *rest.Request, rows int) {
+	if audit != nil && r.Env != nil {
+		r.Env[auditRowsEnvKey] = rows
+	}
+}
+
+func newAuditLog(conf AuditConf) (*auditLog, error) {
+	if conf.File == "" && conf.Table == "" {
+		return nil, nil
+	}
+	a := &auditLog{
+		conf:     conf,
+		maxSize:  100 << 20,
+		maxFiles: 10,
+		entries:  make(chan AuditEntry, auditQueueSize),
+		done:     make(chan struct{}),
+	}
+	if conf.MaxSize > 0 {
+		a.maxSize = int64(conf.MaxSize) << 20
+	}
+	if conf.MaxFiles > 0 {
+		a.maxFiles = conf.MaxFiles
+	}
+
+	if conf.File != "" {
+		if err := a.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Table != "" {
+		if !auditTablePattern.MatchString(conf.Table) {
+			return nil, errors.New("Invalid audit table name: " + conf.Table)
+		}
+		if db.Postgres == nil {
+			return nil, errors.New("The audit table needs a Postgres database")
+		}
+		if err := a.createTable(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *auditLog) openFile() error {
+	f, err := os.OpenFile(a.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *auditLog) createTable() error {
+	var buffer bytes.Buffer
+	buffer.WriteString("CREATE TABLE IF NOT EXISTS ")
+	buffer.WriteString(a.conf.Table)
+	buffer.WriteString(" (time timestamp NOT NULL, key_id text NOT NULL, method text NOT NULL, route text NOT NULL, route_group text NOT NULL,")
+	buffer.WriteString(" territory text NOT NULL, params text NOT NULL, status integer NOT NULL, rows integer, latency_ms double precision NOT NULL,")
+	buffer.WriteString(" bytes bigint NOT NULL, ip text NOT NULL)")
+	if _, err := db.Postgres.Exec(buffer.String()); err != nil {
+		return err
+	}
+	buffer.Reset()
+	buffer.WriteString("CREATE INDEX IF NOT EXISTS ")
+	buffer.WriteString(a.conf.Table)
+	buffer.WriteString("_key_id_time ON ")
+	buffer.WriteString(a.conf.Table)
+	buffer.WriteString(" (key_id, time)")
+	_, err := db.Postgres.Exec(buffer.String())
+	return err
+}
+
+// Queues an entry to be written, dropping it if the writer has fallen too far behind
+func (a *auditLog) Record(entry AuditEntry) {
+	select {
+	case a.entries <- entry:
+	default:
+		a.mu.Lock()
+		a.dropped++
+		dropped := a.dropped
+		a.mu.Unlock()
+		// Don't flood the log, just say so every so often
+		if dropped == 1 || dropped%1000 == 0 {
+			log.Println("Audit log is behind, " + strconv.Itoa(dropped) + " entries dropped")
+		}
+	}
+}
+
+func (a *auditLog) Start() {
+	go func() {
+		defer close(a.done)
+		for entry := range a.entries {
+			a.write(entry)
+		}
+	}()
+}
+
+// Writes whatever is still queued and closes the file
+func (a *auditLog) Stop() {
+	close(a.entries)
+	<-a.done
+	if a.file != nil {
+		a.file.Close()
+	}
+}
+
+func (a *auditLog) write(entry AuditEntry) {
+	if a.file != nil {
+		line, err := json.Marshal(entry)
+		if err == nil {
+			line = append(line, '\n')
+			a.mu.Lock()
+			if a.size+int64(len(line)) > a.maxSize && a.size > 0 {
+				if err := a.rotate(); err != nil {
+					log.Println(err)
+				}
+			}
+			if a.file != nil {
+				n, err := a.file.Write(line)
+				a.size += int64(n)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+	if a.conf.Table != "" && db.Postgres != nil {
+		var buffer bytes.Buffer
+		buffer.WriteString("INSERT INTO ")
+		buffer.WriteString(a.conf.Table)
+		buffer.WriteString(" (time, key_id, method, route, route_group, territory, params, status, rows, latency_ms, bytes, ip)")
+		buffer.WriteString(" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)")
+		_, err := db.Postgres.Exec(buffer.String(), entry.Time.UTC().Format(dbTimeFormat+".000000"), entry.KeyId, entry.Method, entry.Route, entry.Group,
+			entry.Territory, entry.Params, entry.Status, entry.Rows, entry.LatencyMs, entry.Bytes, entry.Ip)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Moves audit.log to audit.log.1 (and .1 to .2, etc., dropping the oldest) and starts a new file. The lock must be held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	os.Remove(a.conf.File + "." + strconv.Itoa(a.maxFiles))
+	for i := a.maxFiles - 1; i >= 1; i-- {
+		os.Rename(a.conf.File+"."+strconv.Itoa(i), a.conf.File+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(a.conf.File, a.conf.File+".1"); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	return a.openFile()
+}
+
+// What to search the audit log for
+type auditQuery struct {
+	KeyId string
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+func (q auditQuery) matches(entry AuditEntry) bool {
+	if q.KeyId != "" && entry.KeyId != q.KeyId {
+		return false
+	}
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Returns the newest entries matching the query. The table is searched if there is one, otherwise the files are.
+func (a *auditLog) Search(q auditQuery) ([]AuditEntry, error) {
+	if a.conf.Table != "" && db.Postgres != nil {
+		return a.searchTable(q)
+	}
+	return a.searchFiles(q)
+}
+
+func (a *auditLog) searchTable(q auditQuery) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	args := []interface{}{}
+	var buffer bytes.Buffer
+	buffer.WriteString("SELECT * FROM ")
+	buffer.WriteString(a.conf.Table)
+	buffer.WriteString(" WHERE true")
+	if q.KeyId != "" {
+		args = append(args, q.KeyId)
+		buffer.WriteString(" AND key_id = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From.UTC().Format(dbTimeFormat))
+		buffer.WriteString(" AND time >= $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To.UTC().Format(dbTimeFormat))
+		buffer.WriteString(" AND time <= $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	buffer.WriteString(" ORDER BY time DESC LIMIT ")
+	buffer.WriteString(strconv.Itoa(q.Limit))
+
+	if err := db.Postgres.Select(&entries, buffer.String(), args...); err != nil {
+		return entries, err
+	}
+	// Times are stored in UTC without a zone
+	for i := range entries {
+		entries[i].Time = time.Date(entries[i].Time.Year(), entries[i].Time.Month(), entries[i].Time.Day(), entries[i].Time.Hour(),
+			entries[i].Time.Minute(), entries[i].Time.Second(), entries[i].Time.Nanosecond(), time.UTC)
+	}
+	return entries, nil
+}
+
+// Reads the current file and then the rotated ones (newer to older) until there are enough entries
+func (a *auditLog) searchFiles(q auditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := []AuditEntry{}
+	files := []string{a.conf.File}
+	for i := 1; i <= a.maxFiles; i++ {
+		files = append(files, a.conf.File+"."+strconv.Itoa(i))
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return found, err
+		}
+		matched := []AuditEntry{}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || !q.matches(entry) {
+				continue
+			}
+			matched = append(matched, entry)
+			// Only the newest in each file are wanted
+			if len(matched) > 2*q.Limit {
+				matched = append(matched[:0], matched[len(matched)-q.Limit:]...)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return found, err
+		}
+
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.After(matched[j].Time) })
+		found = append(found, matched...)
+		if len(found) >= q.Limit {
+			return found[:q.Limit], nil
+		}
+	}
+	return found, nil
+}
+
+// The query string without anything secret
+func auditParams(r *rest.Request) string {
+	queryParams := r.URL.Query()
+	for _, secret := range auditSecretParams {
+		queryParams.Del(secret)
+	}
+	return queryParams.Encode()
+}
+
+// --------- API Audit Middleware. It goes around everything else (as an outer middleware) so it sees the status, the time
+// taken and, once the route has run, the principal, territory and rows.
+type AuditMw struct {
+	Log *auditLog
+	// Trusted proxies in front of the reporter, see requestIp
+	ProxyHops int
+}
+
+func (amw *AuditMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		start := time.Now()
+		handler(w, r)
+
+		entry := AuditEntry{
+			Time:      start.UTC(),
+			Method:    r.Method,
+			Route:     r.URL.Path,
+			Territory: r.PathParam("territory"),
+			Params:    auditParams(r),
+			Status:    http.StatusOK,
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Ip:        requestIp(r, amw.ProxyHops),
+		}
+		if p := requestPrincipal(r); p != nil {
+			entry.KeyId = p.Id
+		}
+		if entry.Territory == "" {
+			if territories := requestTerritories(r); len(territories) > 0 {
+				entry.Territory = territories[0]
+			}
+		}
+		if group, ok := r.Env[routeGroupEnvKey].(string); ok {
+			entry.Group = group
+		}
+		if status, ok := r.Env["STATUS_CODE"].(int); ok && status != 0 {
+			entry.Status = status
+		}
+		if elapsed, ok := r.Env["ELAPSED_TIME"].(*time.Duration); ok {
+			entry.LatencyMs = float64(*elapsed) / float64(time.Millisecond)
+		}
+		if written, ok := r.Env["BYTES_WRITTEN"].(int64); ok {
+			entry.Bytes = written
+		}
+		if rows, ok := r.Env[auditRowsEnvKey].(int); ok {
+			entry.Rows = &rows
+		}
+		amw.Log.Record(entry)
+	}
+}
+
+// --------- API end points ---------
+
+// Searches the audit log by key (?key=, the key's id) and time range (?from=&to=, see dates.go), newest first
+func AuditLogData(w rest.ResponseWriter, r *rest.Request) {
+	if audit == nil {
+		rest.Error(w, "The audit log is not enabled", http.StatusNotImplemented)
+		return
+	}
+	queryParams := r.URL.Query()
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := auditQuery{From: dr.from, To: dr.to, Limit: 100}
+	if len(queryParams["key"]) > 0 {
+		q.KeyId = queryParams["key"][0]
+	}
+	if len(queryParams["limit"]) > 0 {
+		q.Limit, err = strconv.Atoi(queryParams["limit"][0])
+		if err != nil || q.Limit < 1 || q.Limit > maxAuditLimit {
+			rest.Error(w, "Invalid limit: use 1 to "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := audit.Search(q)
+	if err != nil {
+		log.Println(err)
+		rest.Error(w, "The audit log couldn't be searched", http.StatusInternalServerError)
+		return
+	}
+
+	res := setAdminLinks("admin:audit")
+	res.Data["entries"] = entries
+	res.Data["total"] = len(entries)
+	dr.setMeta(res)
+	res.Success()
+	w.WriteJson(res.End())
+}
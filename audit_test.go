@@ -0,0 +1,139 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testAuditEntry(i int) AuditEntry {
+	key := "a"
+	if i%2 == 1 {
+		key = "b"
+	}
+	return AuditEntry{
+		Time:   time.Date(2014, 10, 15, 12, i, 0, 0, time.UTC),
+		KeyId:  key,
+		Method: "GET",
+		Route:  "/territory/count/acme/messages",
+		Status: 200,
+		Ip:     "192.0.2.1",
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(AuditConf{File: file, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if a.file != nil {
+			a.file.Close()
+		}
+	}()
+	// Room for two entries a file
+	line, _ := json.Marshal(testAuditEntry(0))
+	a.maxSize = int64(2*(len(line)+1) + 10)
+
+	for i := 0; i < 9; i++ {
+		a.write(testAuditEntry(i))
+	}
+
+	// 0-1 and 2-3 have been rotated out, leaving 8 in the file, 6-7 in .1 and 4-5 in .2
+	expected := map[string][]int{file: {8}, file + ".1": {6, 7}, file + ".2": {4, 5}}
+	for name, minutes := range expected {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(b)) > a.maxSize {
+			t.Errorf("%s is %d bytes, over the max of %d", name, len(b), a.maxSize)
+		}
+		want := ""
+		for _, i := range minutes {
+			line, _ := json.Marshal(testAuditEntry(i))
+			want += string(line) + "\n"
+		}
+		if string(b) != want {
+			t.Errorf("%s has:\n%s\nwant:\n%s", name, b, want)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only maxFiles old files should be kept, %s.3: %v", file, err)
+	}
+}
+
+func TestAuditLogSearchFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(AuditConf{File: file, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if a.file != nil {
+			a.file.Close()
+		}
+	}()
+	line, _ := json.Marshal(testAuditEntry(0))
+	a.maxSize = int64(3*(len(line)+1) + 10)
+	for i := 0; i < 10; i++ {
+		a.write(testAuditEntry(i))
+	}
+	// Something that isn't an entry is skipped
+	a.file.WriteString("not json\n")
+
+	at := func(i int) time.Time { return testAuditEntry(i).Time }
+	tests := []struct {
+		q    auditQuery
+		want []int
+	}{
+		{auditQuery{Limit: 100}, []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		// Newest first, across files
+		{auditQuery{Limit: 4}, []int{9, 8, 7, 6}},
+		{auditQuery{KeyId: "a", Limit: 100}, []int{8, 6, 4, 2, 0}},
+		{auditQuery{KeyId: "b", Limit: 2}, []int{9, 7}},
+		{auditQuery{From: at(3), To: at(7), Limit: 100}, []int{7, 6, 5, 4, 3}},
+		{auditQuery{KeyId: "a", From: at(3), Limit: 100}, []int{8, 6, 4}},
+		{auditQuery{KeyId: "c", Limit: 100}, []int{}},
+	}
+	for _, tt := range tests {
+		found, err := a.searchFiles(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []int{}
+		for _, entry := range found {
+			got = append(got, entry.Time.Minute())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchFiles(%+v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestAuditParams(t *testing.T) {
+	r := newTestRequest(t, "http://localhost/territory/messages/acme?apiKey=secret&network=twitter&access_token=token&limit=10", "")
+	if params := auditParams(r); params != "limit=10&network=twitter" {
+		t.Errorf("got %q", params)
+	}
+}
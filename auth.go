@@ -0,0 +1,352 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains what an API key is allowed to do. Keys in the shared config (ReporterServer.AuthKeys) can do
+// anything, while keys in the reporter config (see ApiKeyConf) can be limited to some territories and groups of routes
+// and can expire. The auth middleware (see main.go) works out who the request is from, then each route checks that it's
+// allowed (see scoped) before it runs any query.
+//
+// Keys are sent with HTTP Basic auth (RFC 7617, the key as the password or as the user-id with no password), as a Bearer
+// token (RFC 6750) or as ?apiKey= for clients that can't set headers (like EventSource). They should be stored in the
+// config as salted hashes ("reporter hash-key" makes them), so the config doesn't give the keys away. Keys are never logged.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The groups of routes a key can be allowed
+const (
+	// Counts, timeseries, aggregates, top lists, charts, etc.
+	scopeRead = "read"
+	// Messages themselves (and contributors), including the live stream
+	scopeReadMessages = "read-messages"
+	// The bulk export and rendered reports, along with any route asked for as csv, tsv or xlsx
+	scopeExport = "export"
+	scopeAlerts = "alerts"
+	// Scheduled report jobs and the like
+	scopeAdmin = "admin"
+)
+
+var authScopes = []string{scopeRead, scopeReadMessages, scopeExport, scopeAlerts, scopeAdmin}
+
+// Where the middleware leaves who the request is from (an *authPrincipal) in the request's Env
+const authEnvKey = "authPrincipal"
+
+// Where scoped leaves the route group (for the audit log)
+const routeGroupEnvKey = "routeGroup"
+
+// Who a request is from and what they're allowed to do. No territories or scopes means all of them.
+type authPrincipal struct {
+	// Identifies the key (in logs, etc.) without giving it away
+	Id          string
+	Territories []string
+	Scopes      []string
+	Expires     time.Time
+	// HMAC-SHA256 of the key with the salt (for a key stored in plain text, SHA-256 of the key and no salt)
+	salt []byte
+	sum  []byte
+}
+
+// The configured keys, set up by loadApiKeys
+var apiKeys = []*authPrincipal{}
+
+// Hashed keys look like sha256$<salt>$<hash> (both hex)
+const apiKeyHashPrefix = "sha256$"
+
+const apiKeySaltSize = 16
+
+// Returns the salted hash of a key to put in the config
+func hashApiKey(key string) (string, error) {
+	salt := make([]byte, apiKeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return apiKeyHashPrefix + hex.EncodeToString(salt) + "$" + hex.EncodeToString(apiKeySum(salt, key)), nil
+}
+
+func apiKeySum(salt []byte, key string) []byte {
+	if salt == nil {
+		sum := sha256.Sum256([]byte(key))
+		return sum[:]
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(key))
+	return mac.Sum(nil)
+}
+
+// Sets up the principal to check keys against what's in the config, which is either a hash (see hashApiKey) or the key itself.
+// Plain text keys still work, but true is returned so a warning can be given.
+func (p *authPrincipal) setKey(configured string) (bool, error) {
+	if !strings.HasPrefix(configured, apiKeyHashPrefix) {
+		p.sum = apiKeySum(nil, configured)
+		return true, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(configured, apiKeyHashPrefix), "$")
+	if len(parts) != 2 {
+		return false, errors.New("API key " + p.Id + " isn't a valid hash (sha256$<salt>$<hash>)")
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil || len(salt) == 0 {
+		return false, errors.New("API key " + p.Id + " has an invalid salt")
+	}
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil || len(sum) != sha256.Size {
+		return false, errors.New("API key " + p.Id + " has an invalid hash")
+	}
+	p.salt = salt
+	p.sum = sum
+	return false, nil
+}
+
+// Whether the key is this principal's (in constant time)
+func (p *authPrincipal) verify(key string) bool {
+	return subtle.ConstantTimeCompare(apiKeySum(p.salt, key), p.sum) == 1
+}
+
+// Returns the principal for a key, nil if there isn't one. Every key is checked (not just until one matches)
+// so how long it takes doesn't say anything about which keys exist.
+func findPrincipal(key string) *authPrincipal {
+	var found *authPrincipal
+	for _, p := range apiKeys {
+		if p.verify(key) && found == nil {
+			found = p
+		}
+	}
+	return found
+}
+
+var (
+	// RFC 6750 b64token
+	bearerTokenPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+	errNoCredentials   = errors.New("No credentials")
+	errBadCredentials  = errors.New("Malformed credentials")
+)
+
+// Where QueryKeyMw leaves the ?apiKey= it took out of the URL
+const queryKeyEnvKey = "authQueryKey"
+
+// --------- API Query Key Middleware. Takes ?apiKey= out of the URL before anything else sees the request, so it can't
+// end up in the access log (which logs the URL once the request is done) or anywhere else the URL goes.
+type QueryKeyMw struct{}
+
+func (qkmw *QueryKeyMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		queryParams := r.URL.Query()
+		if keys, ok := queryParams["apiKey"]; ok {
+			if len(keys) > 0 {
+				r.Env[queryKeyEnvKey] = keys[0]
+			}
+			queryParams.Del("apiKey")
+			r.URL.RawQuery = queryParams.Encode()
+		}
+		handler(w, r)
+	}
+}
+
+// Returns the key sent with the request: Basic (RFC 7617) or Bearer (RFC 6750) in the Authorization header, or ?apiKey=
+// (see QueryKeyMw). Anything else in the Authorization header, like the key on its own, is malformed.
+func requestCredentials(r *rest.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		if key, _ := r.Env[queryKeyEnvKey].(string); key != "" {
+			return key, nil
+		}
+		return "", errNoCredentials
+	}
+
+	// The scheme is case-insensitive and separated from the credentials by one or more spaces
+	parts := strings.SplitN(strings.TrimSpace(authHeader), " ", 2)
+	if len(parts) != 2 {
+		return "", errBadCredentials
+	}
+	credentials := strings.TrimLeft(parts[1], " ")
+	switch strings.ToLower(parts[0]) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", errBadCredentials
+		}
+		userPass := strings.SplitN(string(decoded), ":", 2)
+		if len(userPass) != 2 {
+			return "", errBadCredentials
+		}
+		// The key can be sent as the password (with any user-id) or as the user-id with an empty password
+		if userPass[1] != "" {
+			return userPass[1], nil
+		}
+		if userPass[0] != "" {
+			return userPass[0], nil
+		}
+		return "", errBadCredentials
+	case "bearer":
+		if !bearerTokenPattern.MatchString(credentials) {
+			return "", errBadCredentials
+		}
+		return credentials, nil
+	}
+	return "", errBadCredentials
+}
+
+// Reads the API keys from the config, an error means one couldn't be read (the server shouldn't start)
+func loadApiKeys(fullAccess []string, keys []ApiKeyConf) ([]*authPrincipal, error) {
+	loaded := []*authPrincipal{}
+	plain := []string{}
+	for i, key := range fullAccess {
+		if key != "" {
+			p := &authPrincipal{Id: "authKeys[" + strconv.Itoa(i) + "]"}
+			isPlain, err := p.setKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if isPlain {
+				plain = append(plain, p.Id)
+			}
+			loaded = append(loaded, p)
+		}
+	}
+	for i, key := range keys {
+		if key.Key == "" {
+			return nil, errors.New("API key " + strconv.Itoa(i) + " has no key")
+		}
+		p := &authPrincipal{Id: key.Id, Territories: key.Territories, Scopes: key.Scopes}
+		if p.Id == "" {
+			p.Id = "apiKeys[" + strconv.Itoa(i) + "]"
+		}
+		for _, scope := range key.Scopes {
+			if !stringInSlice(scope, authScopes) {
+				return nil, errors.New("API key " + p.Id + " has an unknown scope: " + scope + " (use " + strings.Join(authScopes, ", ") + ")")
+			}
+		}
+		if key.Expires != "" {
+			expires, err := parseDate(key.Expires, time.UTC, time.Now(), false)
+			if err != nil {
+				return nil, errors.New("API key " + p.Id + " has an invalid expiry: " + err.Error())
+			}
+			p.Expires = expires
+		}
+		isPlain, err := p.setKey(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		if isPlain {
+			plain = append(plain, p.Id)
+		}
+		loaded = append(loaded, p)
+	}
+	if len(plain) > 0 {
+		log.Println("Some API keys are stored in plain text, use \"reporter hash-key\" to hash them: " + strings.Join(plain, ", "))
+	}
+	return loaded, nil
+}
+
+// The reason the principal can't be used right now, if any
+func (p *authPrincipal) expired(now time.Time) error {
+	if !p.Expires.IsZero() && !now.Before(p.Expires) {
+		return errors.New("Forbidden: the API key expired on " + p.Expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (p *authPrincipal) hasScope(scope string) bool {
+	return len(p.Scopes) == 0 || stringInSlice(scope, p.Scopes)
+}
+
+func (p *authPrincipal) hasTerritory(territory string) bool {
+	return len(p.Territories) == 0 || stringInSlice(territory, p.Territories)
+}
+
+// Returns who the request is from, nil when auth isn't on (or the request was made internally, ie. by the scheduler)
+func requestPrincipal(r *rest.Request) *authPrincipal {
+	if r.Env == nil {
+		return nil
+	}
+	p, _ := r.Env[authEnvKey].(*authPrincipal)
+	return p
+}
+
+// The territories a request is for: the territory in the path, ?territory= or ?territories=a,b
+func requestTerritories(r *rest.Request) []string {
+	territories := []string{}
+	if territory := r.PathParam("territory"); territory != "" {
+		territories = append(territories, territory)
+	}
+	queryParams := r.URL.Query()
+	if len(queryParams["territory"]) > 0 && queryParams["territory"][0] != "" {
+		territories = append(territories, queryParams["territory"][0])
+	}
+	if len(queryParams["territories"]) > 0 {
+		for _, t := range strings.Split(queryParams["territories"][0], ",") {
+			if t = strings.Trim(t, " "); t != "" {
+				territories = append(territories, t)
+			}
+		}
+	}
+	return territories
+}
+
+// Checks the principal may use the route group (and export, for files) and each of the territories, returning why not
+func authorize(p *authPrincipal, scope string, format string, territories []string) error {
+	if p == nil {
+		return nil
+	}
+	if !p.hasScope(scope) {
+		return errors.New("Forbidden: the API key isn't allowed " + scope + " routes")
+	}
+	if format != "" && format != "json" && !p.hasScope(scopeExport) {
+		return errors.New("Forbidden: the API key isn't allowed to export (" + format + ")")
+	}
+	for _, territory := range territories {
+		if !p.hasTerritory(territory) {
+			return errors.New("Forbidden: the API key isn't allowed the territory " + territory)
+		}
+	}
+	return nil
+}
+
+// Wraps a route's handler so it only runs if the request is allowed the route group and its territories
+func scoped(scope string, handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		r.Env[routeGroupEnvKey] = scope
+		if err := authorize(requestPrincipal(r), scope, requestedFormat(r), requestTerritories(r)); err != nil {
+			rest.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,339 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"github.com/ant0ine/go-json-rest/rest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRequest(t *testing.T, url string, authorization string) *rest.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return &rest.Request{Request: req, Env: map[string]interface{}{}}
+}
+
+func basic(userPass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+}
+
+func TestRequestCredentials(t *testing.T) {
+	tests := []struct {
+		authorization string
+		want          string
+		err           error
+	}{
+		{"", "", errNoCredentials},
+		{basic("anything:secret"), "secret", nil},
+		{basic(":secret"), "secret", nil},
+		{basic("secret:"), "secret", nil},
+		{basic("user:pa:ss"), "pa:ss", nil},
+		{basic(":"), "", errBadCredentials},
+		{basic("nocolon"), "", errBadCredentials},
+		{"Basic not-base64!", "", errBadCredentials},
+		{"Bearer abc.DEF-123_~+/=", "abc.DEF-123_~+/=", nil},
+		{"bearer   spaced", "spaced", nil},
+		{"BEARER upper", "upper", nil},
+		{"Bearer bad token", "", errBadCredentials},
+		{"Bearer ", "", errBadCredentials},
+		// The key on its own (as earlier versions took it) isn't accepted
+		{"secret", "", errBadCredentials},
+		{"Digest username=x", "", errBadCredentials},
+	}
+	for _, tt := range tests {
+		got, err := requestCredentials(newTestRequest(t, "http://localhost/territory/list", tt.authorization))
+		if got != tt.want || err != tt.err {
+			t.Errorf("requestCredentials(%q) = %q, %v, want %q, %v", tt.authorization, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestQueryKeyMw(t *testing.T) {
+	r := newTestRequest(t, "http://localhost/territory/stream/acme?network=twitter&apiKey=secret&counts=true", "")
+	var key string
+	var err error
+	(&QueryKeyMw{}).MiddlewareFunc(func(w rest.ResponseWriter, r *rest.Request) {
+		key, err = requestCredentials(r)
+	})(nil, r)
+
+	if key != "secret" || err != nil {
+		t.Errorf("requestCredentials after QueryKeyMw = %q, %v, want the key from ?apiKey=", key, err)
+	}
+	if q := r.URL.Query(); q.Get("apiKey") != "" || q.Get("network") != "twitter" || q.Get("counts") != "true" {
+		t.Errorf("the URL still has the key or lost other params: %s", r.URL.RequestURI())
+	}
+
+	// The header wins over the query
+	r = newTestRequest(t, "http://localhost/territory/list?apiKey=secret", "Bearer other")
+	(&QueryKeyMw{}).MiddlewareFunc(func(w rest.ResponseWriter, r *rest.Request) {
+		key, err = requestCredentials(r)
+	})(nil, r)
+	if key != "other" || err != nil {
+		t.Errorf("requestCredentials = %q, %v, want the Bearer token", key, err)
+	}
+}
+
+func TestLoadApiKeys(t *testing.T) {
+	keys, err := loadApiKeys([]string{"full", ""}, []ApiKeyConf{
+		{Id: "acme", Key: "acme-key", Territories: []string{"acme"}, Scopes: []string{scopeRead, scopeExport}, Expires: "2030-01-01"},
+		{Key: "unnamed"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].Id != "authKeys[0]" || keys[1].Id != "acme" || keys[2].Id != "apiKeys[1]" {
+		t.Fatalf("got %d keys: %+v", len(keys), keys)
+	}
+	if len(keys[0].Scopes) != 0 || len(keys[0].Territories) != 0 {
+		t.Errorf("authKeys should have full access, got %+v", keys[0])
+	}
+	if !keys[1].Expires.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got expiry %v", keys[1].Expires)
+	}
+
+	for _, bad := range []ApiKeyConf{
+		{Id: "no-key"},
+		{Id: "unknown-scope", Key: "k", Scopes: []string{scopeRead, "write"}},
+		{Id: "bad-expiry", Key: "k", Expires: "someday"},
+		{Id: "bad-hash", Key: apiKeyHashPrefix + "nothex$00"},
+	} {
+		if _, err := loadApiKeys(nil, []ApiKeyConf{bad}); err == nil {
+			t.Errorf("%s: expected an error", bad.Id)
+		}
+	}
+}
+
+func TestPrincipalExpired(t *testing.T) {
+	now := time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expires time.Time
+		expired bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Second), false},
+		{now, true},
+		{now.Add(-time.Hour), true},
+	}
+	for _, tt := range tests {
+		p := &authPrincipal{Id: "k", Expires: tt.expires}
+		if err := p.expired(now); (err != nil) != tt.expired {
+			t.Errorf("expires %v: got %v, expected expired %v", tt.expires, err, tt.expired)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	full := &authPrincipal{Id: "full"}
+	reader := &authPrincipal{Id: "reader", Scopes: []string{scopeRead}, Territories: []string{"acme", "globex"}}
+	exporter := &authPrincipal{Id: "exporter", Scopes: []string{scopeRead, scopeExport}, Territories: []string{"acme"}}
+	tests := []struct {
+		p           *authPrincipal
+		scope       string
+		format      string
+		territories []string
+		ok          bool
+	}{
+		// No principal means auth is off
+		{nil, scopeAdmin, "csv", []string{"anything"}, true},
+		{full, scopeAdmin, "xlsx", []string{"anything"}, true},
+		{reader, scopeRead, "", []string{"acme"}, true},
+		{reader, scopeRead, "json", []string{"acme", "globex"}, true},
+		{reader, scopeReadMessages, "", []string{"acme"}, false},
+		{reader, scopeAdmin, "", nil, false},
+		{reader, scopeRead, "csv", []string{"acme"}, false},
+		{reader, scopeRead, "", []string{"acme", "initech"}, false},
+		{exporter, scopeRead, "csv", []string{"acme"}, true},
+		{exporter, scopeRead, "csv", []string{"globex"}, false},
+		// Exporting doesn't stand in for the route's own scope
+		{exporter, scopeAlerts, "csv", []string{"acme"}, false},
+	}
+	for _, tt := range tests {
+		err := authorize(tt.p, tt.scope, tt.format, tt.territories)
+		if (err == nil) != tt.ok {
+			t.Errorf("authorize(%v, %s, %q, %v) = %v, expected ok %v", tt.p, tt.scope, tt.format, tt.territories, err, tt.ok)
+		}
+	}
+}
+
+func TestRequestTerritories(t *testing.T) {
+	tests := []struct {
+		url         string
+		pathParam   string
+		territories string
+	}{
+		{"http://localhost/territory/list", "", ""},
+		{"http://localhost/territory/messages/acme", "acme", "acme"},
+		{"http://localhost/territory/messages/acme?territory=globex", "acme", "acme,globex"},
+		{"http://localhost/alerts/events?territory=acme", "", "acme"},
+		{"http://localhost/territory/overlap?territories=acme,%20globex,,initech", "", "acme,globex,initech"},
+		{"http://localhost/territory/overlap?territory=&territories=", "", ""},
+	}
+	for _, tt := range tests {
+		r := newTestRequest(t, tt.url, "")
+		r.PathParams = map[string]string{"territory": tt.pathParam}
+		if got := strings.Join(requestTerritories(r), ","); got != tt.territories {
+			t.Errorf("requestTerritories(%s) = %s, want %s", tt.url, got, tt.territories)
+		}
+	}
+}
+
+// Sets the principal the way the auth middlewares do
+type testPrincipalMw struct {
+	p *authPrincipal
+}
+
+func (tpmw *testPrincipalMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		if tpmw.p != nil {
+			r.Env[authEnvKey] = tpmw.p
+		}
+		handler(w, r)
+	}
+}
+
+func TestScoped(t *testing.T) {
+	ok := func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"group": r.Env[routeGroupEnvKey].(string)})
+	}
+	reader := &authPrincipal{Id: "reader", Scopes: []string{scopeRead}, Territories: []string{"acme"}}
+	tests := []struct {
+		p      *authPrincipal
+		url    string
+		accept string
+		status int
+	}{
+		{nil, "/territory/aggregate/globex/messages?format=csv", "", http.StatusOK},
+		{reader, "/territory/aggregate/acme/messages", "", http.StatusOK},
+		{reader, "/territory/aggregate/globex/messages", "", http.StatusForbidden},
+		{reader, "/territory/aggregate/acme/messages?territory=globex", "", http.StatusForbidden},
+		{reader, "/territory/overlap?territories=acme,globex", "", http.StatusForbidden},
+		{reader, "/territory/overlap?territories=acme", "", http.StatusOK},
+		{reader, "/territory/messages/acme", "", http.StatusForbidden},
+		{reader, "/territory/aggregate/acme/messages?format=csv", "", http.StatusForbidden},
+		{reader, "/territory/aggregate/acme/messages", "text/csv", http.StatusForbidden},
+		{reader, "/territory/aggregate/acme/messages?format=json", "text/csv", http.StatusOK},
+	}
+	for _, tt := range tests {
+		handler := rest.ResourceHandler{
+			DisableLogger:         true,
+			PreRoutingMiddlewares: []rest.Middleware{&testPrincipalMw{tt.p}},
+		}
+		err := handler.SetRoutes(
+			&rest.Route{HttpMethod: "GET", PathExp: "/territory/aggregate/:territory/:series", Func: scoped(scopeRead, ok)},
+			&rest.Route{HttpMethod: "GET", PathExp: "/territory/overlap", Func: scoped(scopeRead, ok)},
+			&rest.Route{HttpMethod: "GET", PathExp: "/territory/messages/:territory", Func: scoped(scopeReadMessages, ok)},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", "http://localhost"+tt.url, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s (Accept: %s) as %v: got %d, want %d: %s", tt.url, tt.accept, tt.p, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+}
+
+func TestApiKeyHashing(t *testing.T) {
+	hashed, err := hashApiKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, apiKeyHashPrefix) || strings.Contains(hashed, "correct horse") {
+		t.Fatalf("got %s", hashed)
+	}
+	if again, _ := hashApiKey("correct horse"); again == hashed {
+		t.Error("expected a different salt each time")
+	}
+
+	p := &authPrincipal{Id: "hashed"}
+	plain, err := p.setKey(hashed)
+	if err != nil || plain {
+		t.Fatalf("setKey(%s) = %v, %v", hashed, plain, err)
+	}
+	if !p.verify("correct horse") {
+		t.Error("the hashed key didn't verify")
+	}
+	for _, wrong := range []string{"", "correct horse ", "Correct horse", hashed} {
+		if p.verify(wrong) {
+			t.Errorf("verify(%q) should be false", wrong)
+		}
+	}
+
+	// Keys in plain text still work, but say so
+	p = &authPrincipal{Id: "plain"}
+	plain, err = p.setKey("correct horse")
+	if err != nil || !plain {
+		t.Fatalf("setKey of a plain key = %v, %v", plain, err)
+	}
+	if !p.verify("correct horse") || p.verify("correct") {
+		t.Error("the plain key didn't verify as expected")
+	}
+
+	salt := strings.Repeat("ab", apiKeySaltSize)
+	sum := strings.Repeat("cd", 32)
+	for _, malformed := range []string{
+		apiKeyHashPrefix,
+		apiKeyHashPrefix + salt,
+		apiKeyHashPrefix + salt + "$" + sum + "$extra",
+		apiKeyHashPrefix + "$" + sum,
+		apiKeyHashPrefix + "zz$" + sum,
+		apiKeyHashPrefix + salt + "$" + sum[:62],
+		apiKeyHashPrefix + salt + "$" + sum + "00",
+		apiKeyHashPrefix + salt + "$not-hex",
+	} {
+		if _, err := (&authPrincipal{Id: "bad"}).setKey(malformed); err == nil {
+			t.Errorf("setKey(%q) should fail", malformed)
+		}
+	}
+}
+
+func TestFindPrincipal(t *testing.T) {
+	saved := apiKeys
+	defer func() { apiKeys = saved }()
+
+	hashed, _ := hashApiKey("second")
+	keys, err := loadApiKeys([]string{"first"}, []ApiKeyConf{{Id: "second", Key: hashed}, {Id: "third", Key: "third"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKeys = keys
+	for key, id := range map[string]string{"first": "authKeys[0]", "second": "second", "third": "third"} {
+		if p := findPrincipal(key); p == nil || p.Id != id {
+			t.Errorf("findPrincipal(%q) = %v, want %s", key, p, id)
+		}
+	}
+	for _, key := range []string{"", "fourth", hashed} {
+		if p := findPrincipal(key); p != nil {
+			t.Errorf("findPrincipal(%q) = %s, want nil", key, p.Id)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the server rendered charts (SVG or PNG) for embedding in emails, wiki pages, etc.
+// The chart routes mirror the timeseries count, aggregate and top routes and take the same params.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/wcharczuk/go-chart/v2"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anything that go-chart can render (line charts, bar charts)
+type chartRenderable interface {
+	Render(rp chart.RendererProvider, w io.Writer) error
+}
+
+// Returns the chart format (svg by default, or png) and size from the querystring, keeping the size within reason
+func chartOptions(r *rest.Request, defaultWidth int, defaultHeight int) (string, int, int) {
+	queryParams := r.URL.Query()
+	format := "svg"
+	if len(queryParams["format"]) > 0 && queryParams["format"][0] == "png" {
+		format = "png"
+	}
+	size := func(param string, def int) int {
+		if len(queryParams[param]) > 0 {
+			if v, err := strconv.Atoi(queryParams[param][0]); err == nil {
+				def = v
+			}
+		}
+		if def < 20 {
+			def = 20
+		}
+		if def > 2000 {
+			def = 2000
+		}
+		return def
+	}
+	return format, size("width", defaultWidth), size("height", defaultHeight)
+}
+
+// Renders the chart and writes it out (rendered fully first so errors can still be returned properly)
+func writeChart(w rest.ResponseWriter, c chartRenderable, format string) {
+	var out bytes.Buffer
+	var err error
+	if format == "png" {
+		err = c.Render(chart.PNG, &out)
+	} else {
+		err = c.Render(chart.SVG, &out)
+	}
+	if err != nil {
+		log.Println(err)
+		rest.Error(w, "Could not render chart: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	}
+	// Charts for a past range don't change, but there's no telling what range was asked for so keep it short
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.(http.ResponseWriter).Write(out.Bytes())
+}
+
+// Gathers the timeseries counts to chart, returning an error if there isn't enough to draw a line with
+func chartTimeseries(r *rest.Request) ([]time.Time, []float64, error) {
+	xValues := []time.Time{}
+	yValues := []float64{}
+	params, fieldValue, dr, opts, err := buildTimeseriesParams(r)
+	if err != nil {
+		return xValues, yValues, err
+	}
+	if opts.grouped() {
+		return xValues, yValues, errors.New("Charts are of a single series, use one fieldValue and network and no groupBy")
+	}
+	if opts.Resolution.IsZero() || params.Territory == "" || params.Series == "" {
+		return xValues, yValues, errNotEnoughToChart
+	}
+	counts := []ResultTimeseriesCount{}
+	err = eachTimeseriesCount(params, fieldValue, dr, opts, func(count ResultTimeseriesCount) {
+		counts = append(counts, count)
+	})
+	if err != nil {
+		log.Println(err)
+		return xValues, yValues, errChartQuery
+	}
+	for _, count := range downsampleTimeseries(counts, opts.MaxPoints, opts.Downsample) {
+		// Null periods (fill=null, or a moving average that hasn't filled its window) are left out of the line
+		y, ok := timeseriesPointValue(count)
+		if !ok {
+			continue
+		}
+		t, _ := time.ParseInLocation(dbTimeFormat, count.TimeFrom, dr.Location)
+		xValues = append(xValues, t)
+		yValues = append(yValues, y)
+	}
+	// A line needs at least two points
+	if len(xValues) < 2 {
+		return xValues, yValues, errNotEnoughToChart
+	}
+	return xValues, yValues, nil
+}
+
+var errNotEnoughToChart = errors.New("Not enough data to chart (a territory, series, from, to and resolution are required)")
+
+var errChartQuery = errors.New("The timeseries couldn't be counted")
+
+// Bad params are the client's fault, a failed query isn't
+func chartErrorStatus(err error) int {
+	if err == errChartQuery {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+// More bars than this can't be read (or labelled) at any chart size
+const maxChartBars = 50
+
+// Bars for the first field of an aggregate
+func chartBars(aggregate []ResultAggregateFields, field string) []chart.Value {
+	bars := []chart.Value{}
+	for _, fc := range aggregate {
+		for _, c := range fc.Count[field] {
+			// Cut by characters, not bytes, so hashtags and keywords in other scripts aren't split
+			label := []rune(c.Value)
+			if len(label) > 30 {
+				label = append(label[:27], []rune("...")...)
+			}
+			bars = append(bars, chart.Value{Label: string(label), Value: float64(c.Count)})
+		}
+	}
+	return bars
+}
+
+// The y axis always starts at 0 (go-chart can't draw a range of nothing, which it would otherwise get from a single bar or bars
+// that are all the same)
+func newBarChart(bars []chart.Value, title string, width int, height int) chart.BarChart {
+	max := 1.0
+	for _, b := range bars {
+		if b.Value > max {
+			max = b.Value
+		}
+	}
+	return chart.BarChart{
+		Title:  title,
+		Width:  width,
+		Height: height,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40},
+		},
+		YAxis: chart.YAxis{
+			Range: &chart.ContinuousRange{Min: 0, Max: max},
+		},
+		Bars: bars,
+	}
+}
+
+// --------- API end points ---------
+
+// Returns a line chart of a timeseries count (same params as the timeseries count route)
+func ChartTimeseriesCount(w rest.ResponseWriter, r *rest.Request) {
+	format, width, height := chartOptions(r, 800, 300)
+	xValues, yValues, err := chartTimeseries(r)
+	if err != nil {
+		rest.Error(w, err.Error(), chartErrorStatus(err))
+		return
+	}
+
+	graph := chart.Chart{
+		Title:  r.PathParam("territory"),
+		Width:  width,
+		Height: height,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40},
+		},
+		XAxis: chart.XAxis{
+			ValueFormatter: chart.TimeDateValueFormatter,
+		},
+		Series: []chart.Series{
+			chart.TimeSeries{
+				Name:    r.PathParam("field"),
+				XValues: xValues,
+				YValues: yValues,
+			},
+		},
+	}
+	writeChart(w, graph, format)
+}
+
+// Returns a sparkline (a small line with no axes) of a timeseries count
+func ChartSparklineCount(w rest.ResponseWriter, r *rest.Request) {
+	format, width, height := chartOptions(r, 120, 30)
+	xValues, yValues, err := chartTimeseries(r)
+	if err != nil {
+		rest.Error(w, err.Error(), chartErrorStatus(err))
+		return
+	}
+
+	graph := chart.Chart{
+		Width:  width,
+		Height: height,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 2, Left: 2, Right: 2, Bottom: 2},
+		},
+		XAxis: chart.XAxis{Style: chart.Hidden()},
+		YAxis: chart.YAxis{Style: chart.Hidden()},
+		Series: []chart.Series{
+			chart.TimeSeries{
+				Style: chart.Style{
+					StrokeWidth: 1.5,
+				},
+				XValues: xValues,
+				YValues: yValues,
+			},
+		},
+	}
+	writeChart(w, graph, format)
+}
+
+// Returns a bar chart of the values for the first field of an aggregate (same params as the aggregate route)
+func ChartAggregate(w rest.ResponseWriter, r *rest.Request) {
+	format, width, height := chartOptions(r, 800, 400)
+	params, fields, extraParams, _, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Limit == 0 {
+		params.Limit = 10
+	} else if params.Limit > maxChartBars {
+		params.Limit = maxChartBars
+	}
+	if params.Territory == "" || params.Series == "" || len(fields) == 0 || fields[0] == "" {
+		rest.Error(w, "A territory, series and field are required", http.StatusBadRequest)
+		return
+	}
+
+	aggregate, _ := db.FieldCounts(params, fields[:1], extraParams)
+	bars := chartBars(aggregate, fields[0])
+	if len(bars) == 0 {
+		rest.Error(w, "No data to chart", http.StatusNotFound)
+		return
+	}
+	writeChart(w, newBarChart(bars, fields[0], width, height), format)
+}
+
+// Returns a bar chart of one of the top lists (images, links, hashtags, etc.)
+func ChartTop(w rest.ResponseWriter, r *rest.Request) {
+	format, width, height := chartOptions(r, 800, 400)
+	kind := r.PathParam("list")
+	if _, ok := topLists[kind]; !ok {
+		rest.NotFound(w, r)
+		return
+	}
+	params, _, extraParams, _, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Limit == 0 {
+		params.Limit = 10
+	} else if params.Limit > maxChartBars {
+		params.Limit = maxChartBars
+	}
+	fields := applyTopList(kind, &params, extraParams)
+
+	aggregate, _ := db.FieldCounts(params, fields, extraParams)
+	bars := chartBars(aggregate, fields[0])
+	if len(bars) == 0 {
+		rest.Error(w, "No data to chart", http.StatusNotFound)
+		return
+	}
+	writeChart(w, newBarChart(bars, "Top "+strings.Title(kind), width, height), format)
+}
@@ -0,0 +1,52 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"github.com/wcharczuk/go-chart/v2"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestBarChartRendersFlatData(t *testing.T) {
+	tests := map[string][]chart.Value{
+		"one bar":    {{Label: "a", Value: 3}},
+		"same value": {{Label: "a", Value: 2}, {Label: "b", Value: 2}},
+		"all zero":   {{Label: "a", Value: 0}, {Label: "b", Value: 0}},
+	}
+	for name, bars := range tests {
+		var buffer bytes.Buffer
+		if err := newBarChart(bars, "test", 400, 300).Render(chart.SVG, &buffer); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestChartBarsTruncatesByCharacter(t *testing.T) {
+	long := ""
+	for i := 0; i < 40; i++ {
+		long += "日"
+	}
+	bars := chartBars([]ResultAggregateFields{{Count: map[string][]ResultAggregateCount{"tag": {{Value: long, Count: 1}}}}}, "tag")
+	if len(bars) != 1 {
+		t.Fatalf("got %d bars, want 1", len(bars))
+	}
+	if !utf8.ValidString(bars[0].Label) || utf8.RuneCountInString(bars[0].Label) != 30 {
+		t.Errorf("label %q isn't 30 valid characters", bars[0].Label)
+	}
+}
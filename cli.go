@@ -0,0 +1,356 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the command line reporting/exporting mode, ie. `reporter top hashtags -territory=myTerritory -format=csv`
+// These run the same queries as the API and print to stdout so reports can be scripted (from cron, etc.) without the server.
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const cliUsage = `Usage: reporter [-conf=social-harvest-conf.json] <command> [options]
+
+Commands:
+  count              Count records in a series (optionally where -field equals -value)
+  aggregate          Count the distinct values of one or more -fields in a series
+  top <list>         Top images, videos, audio, links, keywords, hashtags, locations or contributors
+  export messages    Export every message for a territory as ndjson or parquet
+  report             Render a territory report as html or pdf
+  hash-key           Hash an API key (read from stdin) for the config
+
+Run "reporter <command> -h" to see the options for a command.
+With no command, the API server is started.
+`
+
+// Options shared by the reporting commands
+type cliOptions struct {
+	Territory  string
+	Series     string
+	Field      string
+	Value      string
+	Fields     string
+	Network    string
+	From       string
+	To         string
+	Timezone   string
+	Limit      uint64
+	Skip       uint64
+	Format     string
+	Precision  int
+	Sort       string
+	Gzip       bool
+	Out        string
+	Conditions BasicConditions
+}
+
+func (o *cliOptions) params() CommonQueryParams {
+	params := CommonQueryParams{
+		Territory: o.Territory,
+		Series:    o.Series,
+		Field:     o.Field,
+		Network:   o.Network,
+		Limit:     o.Limit,
+		Skip:      o.Skip,
+	}
+	o.dateRange().apply(&params)
+	return params
+}
+
+// The -from and -to range in the -tz timezone (which is checked once the flags are parsed, see checkDateRange)
+func (o *cliOptions) dateRange() dateRange {
+	dr, _ := newDateRange(o.From, o.To, o.Timezone)
+	return dr
+}
+
+func (o *cliOptions) checkDateRange(stderr io.Writer) bool {
+	if _, err := newDateRange(o.From, o.To, o.Timezone); err != nil {
+		fmt.Fprintln(stderr, err)
+		return false
+	}
+	return true
+}
+
+func newCommandFlags(name string, o *cliOptions, defaultFormat string, formats string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.Territory, "territory", "", "The territory to report on (required).")
+	fs.StringVar(&o.Network, "network", "", "Only include this network.")
+	fs.StringVar(&o.From, "from", "", "The start of the date range, ie. 2014-10-01, now-7d or last-month")
+	fs.StringVar(&o.To, "to", "", "The end of the date range, ie. 2014-11-01 or now")
+	fs.StringVar(&o.Timezone, "tz", "", "The timezone (IANA name, ie. America/New_York) for the date range and any days, weeks, etc. Defaults to UTC.")
+	fs.StringVar(&o.Format, "format", defaultFormat, "Output format: "+formats+".")
+	return fs
+}
+
+// Runs a command line report, returning the exit code. Results go to stdout, errors to stderr.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	var o cliOptions
+	var fs *flag.FlagSet
+	var table func() (interface{}, exportTable)
+
+	switch args[0] {
+	case "count":
+		fs = newCommandFlags("count", &o, "table", "json, csv, tsv or table")
+		fs.StringVar(&o.Series, "series", "messages", "The series to count.")
+		fs.StringVar(&o.Field, "field", "", "Only count records where this field...")
+		fs.StringVar(&o.Value, "value", "", "...equals this value.")
+		table = func() (interface{}, exportTable) {
+			count := db.Count(o.params(), o.Value)
+			return count, countTable([]ResultCount{count})
+		}
+		args = args[1:]
+	case "aggregate":
+		fs = newCommandFlags("aggregate", &o, "table", "json, csv, tsv or table")
+		fs.StringVar(&o.Series, "series", "messages", "The series to aggregate.")
+		fs.StringVar(&o.Fields, "fields", "", "Comma separated fields to group by (required).")
+		fs.Uint64Var(&o.Limit, "limit", 0, "Only return this many values per field.")
+		fs.Uint64Var(&o.Skip, "skip", 0, "Skip this many values per field.")
+		table = func() (interface{}, exportTable) {
+			fields := strings.Split(o.Fields, ",")
+			for i, val := range fields {
+				fields[i] = strings.Trim(val, " ")
+			}
+			aggregate, _ := db.FieldCounts(o.params(), fields, map[string]string{})
+			return aggregate, aggregateTable(aggregate)
+		}
+		args = args[1:]
+	case "top":
+		if len(args) < 2 {
+			fmt.Fprintln(stderr, "Which top list? images, videos, audio, links, keywords, hashtags, locations or contributors")
+			return 2
+		}
+		kind := args[1]
+		fs = newCommandFlags("top "+kind, &o, "table", "json, csv, tsv or table")
+		fs.Uint64Var(&o.Limit, "limit", 10, "How many to return.")
+		fs.Uint64Var(&o.Skip, "skip", 0, "Skip this many.")
+		switch kind {
+		case "contributors":
+			fs.StringVar(&o.Sort, "sort", "messages", "Rank by messages, reach or engagement.")
+			fs.StringVar(&o.Conditions.Lang, "lang", "", "Only contributors with this language.")
+			fs.StringVar(&o.Conditions.Country, "country", "", "Only contributors from this country.")
+			table = func() (interface{}, exportTable) {
+				contributors, _ := db.TopContributors(o.params(), o.Conditions, o.Sort)
+				return contributors, structsTable(contributors)
+			}
+		default:
+			if _, ok := topLists[kind]; !ok {
+				fmt.Fprintln(stderr, "Unknown top list: "+kind)
+				return 2
+			}
+			if kind == "locations" {
+				fs.IntVar(&o.Precision, "precision", 7, "Geohash precision (1-12) used to cluster locations.")
+			}
+			table = func() (interface{}, exportTable) {
+				extraParams := map[string]string{}
+				params := o.params()
+				fields := applyTopList(kind, &params, extraParams)
+				if kind == "locations" && o.Precision >= 1 && o.Precision <= 12 {
+					fields[0] = geohashPrecisionField(o.Precision)
+				}
+				aggregate, _ := db.FieldCounts(params, fields, extraParams)
+				return aggregate, aggregateTable(aggregate)
+			}
+		}
+		args = args[2:]
+	case "export":
+		if len(args) < 2 || args[1] != "messages" {
+			fmt.Fprintln(stderr, "Only messages can be exported: reporter export messages -territory=...")
+			return 2
+		}
+		fs = newCommandFlags("export messages", &o, "ndjson", "ndjson or parquet")
+		fs.BoolVar(&o.Gzip, "gzip", false, "Gzip the ndjson output.")
+		fs.StringVar(&o.Out, "out", "", "Write to this file instead of stdout.")
+		fs.StringVar(&o.Conditions.Lang, "lang", "", "Only messages with this contributor language.")
+		fs.StringVar(&o.Conditions.Country, "country", "", "Only messages with this contributor country.")
+		fs.StringVar(&o.Conditions.Gender, "gender", "", "Only messages with this contributor gender.")
+		fs.StringVar(&o.Conditions.Geohash, "geohash", "", "Only messages near this geohash.")
+		fs.SetOutput(stderr)
+		if err := fs.Parse(args[2:]); err != nil {
+			return 2
+		}
+		return runExportMessages(&o, stdout, stderr)
+	case "report":
+		fs = newCommandFlags("report", &o, "html", "html or pdf")
+		fs.StringVar(&o.Out, "out", "", "Write to this file instead of stdout.")
+		fs.SetOutput(stderr)
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		return runReport(&o, stdout, stderr)
+	case "hash-key":
+		return runHashKey(os.Stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintln(stderr, "Unknown command: "+args[0])
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if o.Territory == "" {
+		fmt.Fprintln(stderr, "A -territory is required.")
+		return 2
+	}
+	if !o.checkDateRange(stderr) {
+		return 2
+	}
+	if o.Series == "" {
+		o.Series = "messages"
+	}
+	switch o.Format {
+	case "json", "csv", "tsv", "table":
+	default:
+		fmt.Fprintln(stderr, "Unknown format: "+o.Format+" (json, csv, tsv or table)")
+		return 2
+	}
+
+	results, t := table()
+	switch o.Format {
+	case "json":
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintln(stdout, string(out))
+	case "csv", "tsv":
+		if err := writeTable(stdout, o.Format, t); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	case "table":
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.Columns, "\t"))
+		for _, row := range t.Rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		tw.Flush()
+	}
+
+	return 0
+}
+
+func runExportMessages(o *cliOptions, stdout io.Writer, stderr io.Writer) int {
+	if o.Territory == "" {
+		fmt.Fprintln(stderr, "A -territory is required.")
+		return 2
+	}
+	if !o.checkDateRange(stderr) {
+		return 2
+	}
+	if _, ok := bulkExportContentTypes[o.Format]; !ok {
+		fmt.Fprintln(stderr, "Unknown format: "+o.Format+" (ndjson or parquet)")
+		return 2
+	}
+
+	out := stdout
+	if o.Out != "" {
+		f, err := os.Create(o.Out)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if o.Gzip && o.Format == "ndjson" {
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+
+	o.Series = "messages"
+	if _, err := writeMessagesExport(out, o.Format, o.params(), o.Conditions); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runReport(o *cliOptions, stdout io.Writer, stderr io.Writer) int {
+	if o.Territory == "" {
+		fmt.Fprintln(stderr, "A -territory is required.")
+		return 2
+	}
+	if !o.checkDateRange(stderr) {
+		return 2
+	}
+	if o.Format != "html" && o.Format != "pdf" {
+		fmt.Fprintln(stderr, "Unknown format: "+o.Format+" (html or pdf)")
+		return 2
+	}
+
+	out := stdout
+	if o.Out != "" {
+		f, err := os.Create(o.Out)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	report, err := buildTerritoryReport(o.params(), o.dateRange())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err = renderTerritoryReport(out, report, o.Format); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Reads a key from stdin (so it doesn't end up in the shell history) and prints its salted hash for the config
+func runHashKey(stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	key := strings.TrimRight(line, "\r\n")
+	if key == "" {
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(stderr, err)
+		} else {
+			fmt.Fprintln(stderr, "Pipe the key in, ie. reporter hash-key < key.txt")
+		}
+		return 2
+	}
+	hash, err := hashApiKey(key)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, hash)
+	return 0
+}
@@ -0,0 +1,180 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the configuration that only the reporter uses.
+// It's read from the same JSON file as the rest of the Social Harvest configuration (the harvester simply ignores it),
+// but it doesn't belong in the shared config package.
+package main
+
+// Reporter only settings. These sit alongside the shared settings under "reporterServer" in the config file.
+type ReporterConf struct {
+	ReporterServer struct {
+		Scheduler SchedulerConf `json:"scheduler"`
+		Reports   ReportsConf   `json:"reports"`
+		Alerts    AlertsConf    `json:"alerts"`
+		Stream    StreamConf    `json:"stream"`
+		// Keys with limited access (keys in authKeys can do anything)
+		ApiKeys   []ApiKeyConf  `json:"apiKeys"`
+		Jwt       JwtConf       `json:"jwt"`
+		RateLimit RateLimitConf `json:"rateLimit"`
+		Audit     AuditConf     `json:"audit"`
+	} `json:"reporterServer"`
+}
+
+// An API key limited to some territories and groups of routes (read, read-messages, export, alerts, admin), see auth.go.
+// Leaving out territories or scopes allows all of them. Expires is a date or time (2015-01-01 or 2015-01-01T00:00:00Z).
+// Key should be the salted hash from "reporter hash-key" rather than the key itself.
+type ApiKeyConf struct {
+	// Names the key in logs, etc.
+	Id          string   `json:"id"`
+	Key         string   `json:"key"`
+	Territories []string `json:"territories,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	Expires     string   `json:"expires,omitempty"`
+}
+
+// Rendered (HTML/PDF) reports. PDFs are rendered from the HTML by an external command that reads HTML on stdin
+// and writes the PDF to stdout, ie. ["wkhtmltopdf", "--quiet", "-", "-"]
+type ReportsConf struct {
+	PdfCommand []string `json:"pdfCommand"`
+	// How long the command gets before it's killed (a Go duration, 1m by default)
+	PdfTimeout string `json:"pdfTimeout"`
+}
+
+// Scheduled reports, ie. {"reporterServer": {"scheduler": {"directory": "reports", "smtp": {...}, "jobs": [...]}}}
+type SchedulerConf struct {
+	// Where report files are written (they're always written, emailing is optional)
+	Directory string      `json:"directory"`
+	Smtp      SmtpConf    `json:"smtp"`
+	Jobs      []ReportJob `json:"jobs"`
+}
+
+type SmtpConf struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// A named report that runs on a cron schedule. The report is any API endpoint (path) with querystring params and a format.
+type ReportJob struct {
+	Name     string            `json:"name"`
+	Schedule string            `json:"schedule"`
+	Endpoint string            `json:"endpoint"`
+	Params   map[string]string `json:"params"`
+	Format   string            `json:"format"`
+	// Optional, email the report to these addresses
+	Email   []string `json:"email,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+}
+
+// Threshold alerts, ie. {"reporterServer": {"alerts": {"interval": "1m", "secret": "...", "webhooks": [...], "rules": [...]}}}
+type AlertsConf struct {
+	// How often the rules are evaluated (a Go duration, defaults to 1m)
+	Interval string `json:"interval"`
+	// Webhook payloads are signed (HMAC-SHA256) with this so receivers can verify them
+	Secret   string      `json:"secret"`
+	Webhooks []string    `json:"webhooks"`
+	Rules    []AlertRule `json:"rules"`
+}
+
+// A threshold on a territory. The value checked depends on the kind of rule. For "count" it's the number of records in the window,
+// for "change" it's the count in the window divided by the count in the window before it (2 means it doubled) and for "share"
+// it's the fraction of records in the window where field equals value (0.3 means 30%).
+type AlertRule struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Territory string `json:"territory"`
+	Series    string `json:"series,omitempty"`
+	Network   string `json:"network,omitempty"`
+	Field     string `json:"field,omitempty"`
+	Value     string `json:"value,omitempty"`
+	// A Go duration, ie. "1h"
+	Window string `json:"window"`
+	// Fire when the value goes above and/or below these
+	Above *float64 `json:"above,omitempty"`
+	Below *float64 `json:"below,omitempty"`
+	// Change and share rules don't fire until the window has at least this many records (avoids noise when things are quiet)
+	MinCount int `json:"minCount,omitempty"`
+	// Optional, in addition to the webhooks for all alerts
+	Webhooks []string `json:"webhooks,omitempty"`
+}
+
+// The live message stream. New messages are found by polling, but if the harvester (or a trigger) sends a NOTIFY on
+// notifyChannel when it saves messages, streams will poll right away instead of waiting for the next interval.
+type StreamConf struct {
+	// Go durations, defaults are 2s and 1m
+	PollInterval string `json:"pollInterval"`
+	// Messages are saved with the time they were posted, which can be a little before they were harvested.
+	// Each poll looks back this far so those aren't missed (anything already sent isn't sent again).
+	Lookback string `json:"lookback"`
+	// How far back a reconnecting client can pick up from (Last-Event-ID), defaults to 5m. Anything older is skipped.
+	Resume        string `json:"resume"`
+	NotifyChannel string `json:"notifyChannel"`
+	// The most streams that can be open at once, defaults to 100
+	MaxClients int `json:"maxClients"`
+}
+
+// JWT auth (see jwt.go), on when jwks is set. Tokens must be from the issuer and for one of the audiences.
+type JwtConf struct {
+	// A file path or URL
+	Jwks     string   `json:"jwks"`
+	Issuer   string   `json:"issuer"`
+	Audience []string `json:"audience"`
+	// Go durations. How often the JWKS is fetched again (defaults to 1h) and how much clock skew is allowed (defaults to 1m).
+	Refresh string `json:"refresh,omitempty"`
+	Leeway  string `json:"leeway,omitempty"`
+	// The claims with the territories ("territories" by default, "*" for all) and scopes ("scope" by default)
+	TerritoriesClaim string `json:"territoriesClaim,omitempty"`
+	ScopesClaim      string `json:"scopesClaim,omitempty"`
+	// The scopes for tokens that don't have any of ours (defaults to read)
+	DefaultScopes []string `json:"defaultScopes,omitempty"`
+}
+
+// Rate limits (see ratelimit.go), ie. {"perKey": {"requests": 60, "per": "1m", "burst": 20}, "perIp": {...}, "dailyQuota": 10000}
+// Leaving any of them out means no limit. The daily quota is per key and resets at midnight UTC.
+type RateLimitConf struct {
+	PerKey     RateLimitRule `json:"perKey"`
+	PerIp      RateLimitRule `json:"perIp"`
+	DailyQuota int           `json:"dailyQuota"`
+	// Use X-Forwarded-For for the client's IP (only if the reporter is behind a proxy that sets it), the audit log uses this too
+	TrustProxy bool `json:"trustProxy"`
+	// How many proxies are in front of the reporter, each adding to X-Forwarded-For (1 by default)
+	ProxyHops int `json:"proxyHops"`
+}
+
+// So many requests per period (a Go duration, 1s by default), with bursts of up to burst (requests by default)
+type RateLimitRule struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+	Burst    int    `json:"burst"`
+}
+
+// The audit log (see audit.go), written to a file and/or a database table
+type AuditConf struct {
+	// A JSON lines file, rotated once it's maxSize MB (100 by default) keeping maxFiles old files (10 by default)
+	File     string `json:"file"`
+	MaxSize  int    `json:"maxSize"`
+	MaxFiles int    `json:"maxFiles"`
+	// A Postgres table, created if it doesn't exist
+	Table string `json:"table"`
+}
+
+var reporterConfig = ReporterConf{}
+
+// The directory the config file is in (templates, etc. can be overridden from here)
+var reporterConfigDir = "."
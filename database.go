@@ -21,16 +21,21 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
+	"errors"
 	"github.com/SocialHarvest/harvester/lib/config"
 	influxdb "github.com/influxdb/influxdb/client"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	//"github.com/mitchellh/mapstructure"
 	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type SocialHarvestDB struct {
@@ -74,7 +79,7 @@ func newDatabase(c config.SocialHarvestConf) *SocialHarvestDB {
 		}
 	case "postgres", "postgresql":
 		// Note that sqlx just wraps database/sql and `database.Postgres` gets a sqlx.DB which is essentially a wrapped sql.DB
-		db.Postgres, err = sqlx.Connect("postgres", "host="+c.Database.Host+" port="+strconv.Itoa(c.Database.Port)+" sslmode=disable dbname="+c.Database.Database+" user="+c.Database.User+" password="+c.Database.Password)
+		db.Postgres, err = sqlx.Connect("postgres", postgresConnString(c))
 		if err != nil {
 			log.Println(err)
 			return &db
@@ -88,6 +93,11 @@ func newDatabase(c config.SocialHarvestConf) *SocialHarvestDB {
 	return &db
 }
 
+// The connection string for Postgres (also used to LISTEN for notifications, see stream.go)
+func postgresConnString(c config.SocialHarvestConf) string {
+	return "host=" + c.Database.Host + " port=" + strconv.Itoa(c.Database.Port) + " sslmode=disable dbname=" + c.Database.Database + " user=" + c.Database.User + " password=" + c.Database.Password
+}
+
 // Checks access to the database
 func (db *SocialHarvestDB) HasAccess() bool {
 	var err error
@@ -126,6 +136,8 @@ type CommonQueryParams struct {
 	Limit     uint64 `json:"limit,omitempty"`
 	Series    string `json:"series,omitempty"`
 	Skip      uint64 `json:"skip,omitempty"`
+	// IANA name, used to bucket by day, week, etc. (the range itself is always given in UTC, see dates.go)
+	Timezone string `json:"timezone,omitempty"`
 }
 
 type ResultCount struct {
@@ -134,6 +146,22 @@ type ResultCount struct {
 	TimeTo   string `json:"timeTo"`
 }
 
+// A period in a timeseries. The count is null for empty periods when that's the fill policy (see timeseries.go).
+type ResultTimeseriesCount struct {
+	Count    *int   `json:"count"`
+	TimeFrom string `json:"timeFrom"`
+	TimeTo   string `json:"timeTo"`
+	// The timezone TimeFrom and TimeTo are in
+	Timezone string `json:"timezone"`
+	// The value of the grouped field when there are several series
+	Series string `json:"series,omitempty"`
+	// The range ended part way through this period
+	Partial bool `json:"partial,omitempty"`
+	// The count after the requested transform (a moving average, running total, etc.), the count is left as it was
+	Transform string   `json:"transform,omitempty"`
+	Value     *float64 `json:"value,omitempty"`
+}
+
 type ResultAggregateCount struct {
 	Count int    `json:"count"`
 	Value string `json:"value"`
@@ -154,11 +182,12 @@ type ResultAggregateFields struct {
 }
 
 type BasicConditions struct {
-	Gender     string `json:"contributor_gender,omitempty"`
-	Lang       string `json:"contributor_lang,omitempty"`
-	Country    string `json:"contributor_country,omitempty"`
-	IsQuestion int    `json:"is_question,omitempty"`
-	Geohash    string `json:"contributor_geohash,omitempty"`
+	Gender        string `json:"contributor_gender,omitempty"`
+	Lang          string `json:"contributor_lang,omitempty"`
+	Country       string `json:"contributor_country,omitempty"`
+	IsQuestion    int    `json:"is_question,omitempty"`
+	Geohash       string `json:"contributor_geohash,omitempty"`
+	ContributorId string `json:"contributor_id,omitempty"`
 }
 
 // Sanitizes common query params to prevent SQL injection and to ensure proper formatting, etc.
@@ -199,8 +228,15 @@ func SanitizeCommonQueryParams(params CommonQueryParams) CommonQueryParams {
 		sanitizedParams.Network = params.Network
 	}
 
+	// Only known timezones (these go into the SQL so the characters are checked too, names are like America/Port-au-Prince or Etc/GMT+5)
+	if params.Timezone != "" && regexp.MustCompile(`^[A-Za-z0-9_/+\-]+$`).MatchString(params.Timezone) {
+		if loc, err := time.LoadLocation(params.Timezone); err == nil {
+			sanitizedParams.Timezone = loc.String()
+		}
+	}
+
 	// to/from are dates and there's only certain characters necessary there too. Fore xample, something like 2014-08-08 12:00:00 is all we need.
-	// TODO: Maybe timezone too? All dates should be UTC so there may really be no need.
+	// All dates are UTC (the API converts from the requested timezone before querying, see dates.go).
 	// Look for anything other than numbers, a single dash, colons, and spaces. Then also trim a dash at the end of the string in case. It's an invalid query really, but let it work still (for now).
 	pattern = `\-{2,}|\"|\'|[A-z]|\#|\;|\*|\!|\\|\/|\(|\)|\|`
 	r, _ = regexp.Compile(pattern)
@@ -215,6 +251,14 @@ func SanitizeCommonQueryParams(params CommonQueryParams) CommonQueryParams {
 	return sanitizedParams
 }
 
+// The time column in the query's timezone, for bucketing by day, week, etc. (times are stored in UTC)
+func localTimeColumn(sanitizedQueryParams CommonQueryParams) string {
+	if sanitizedQueryParams.Timezone == "" || sanitizedQueryParams.Timezone == "UTC" {
+		return "time"
+	}
+	return "(time AT TIME ZONE 'UTC' AT TIME ZONE '" + sanitizedQueryParams.Timezone + "')"
+}
+
 // Groups fields values and returns a count of occurences
 func (db *SocialHarvestDB) FieldCounts(queryParams CommonQueryParams, fields []string, extraParams map[string]string) ([]ResultAggregateFields, ResultCount) {
 	var fieldCounts []ResultAggregateFields
@@ -390,13 +434,21 @@ func (db *SocialHarvestDB) FieldCounts(queryParams CommonQueryParams, fields []s
 // Returns total number of records for a given territory and series. Optional conditions for network, field/value, and date range. This is just a simple COUNT().
 // However, since it accepts a date range, it could be called a few times to get a time series graph.
 func (database *SocialHarvestDB) Count(queryParams CommonQueryParams, fieldValue string) ResultCount {
+	count, err := database.CountE(queryParams, fieldValue)
+	if err != nil {
+		log.Println(err)
+	}
+	return count
+}
+
+// The same as Count, but the query error is returned (so a failed query isn't mistaken for a count of 0, which matters to alerts)
+func (database *SocialHarvestDB) CountE(queryParams CommonQueryParams, fieldValue string) (ResultCount, error) {
 	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
 	var count = ResultCount{}
+	var err error
 
 	if db.Postgres != nil {
 		// The following query should work for pretty much any SQL database (at least any we're supporting)
-		var err error
-
 		var buffer bytes.Buffer
 		buffer.WriteString("SELECT COUNT(*) AS count FROM ")
 		buffer.WriteString(sanitizedQueryParams.Series)
@@ -429,30 +481,174 @@ func (database *SocialHarvestDB) Count(queryParams CommonQueryParams, fieldValue
 		if sanitizedQueryParams.Network != "" {
 			buffer.WriteString(" AND network")
 			// Must everything be so different?
-			buffer.WriteString(" = $2")
+			if sanitizedQueryParams.Field != "" && fieldValue != "" {
+				buffer.WriteString(" = $2")
+			} else {
+				buffer.WriteString(" = $1")
+			}
 		}
 
 		query := buffer.String()
 		buffer.Reset()
-		if err != nil {
-		}
 
-		// TODO: There has to be a better way to do this.... Need to pass a variable number of args
-		if fieldValue != "" && sanitizedQueryParams.Network == "" {
-			err = db.Postgres.Get(&count, query, fieldValue)
-		} else if fieldValue != "" && sanitizedQueryParams.Network != "" {
-			err = db.Postgres.Get(&count, query, fieldValue, sanitizedQueryParams.Network)
-		} else if fieldValue == "" && sanitizedQueryParams.Network != "" {
-			err = db.Postgres.Get(&count, query, sanitizedQueryParams.Network)
-		} else {
-			err = db.Postgres.Get(&count, query)
+		// The args have to line up with the placeholders used above
+		args := []interface{}{}
+		if sanitizedQueryParams.Field != "" && fieldValue != "" {
+			args = append(args, fieldValue)
+		}
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
 		}
+		err = db.Postgres.Get(&count, query, args...)
 
 		count.TimeFrom = sanitizedQueryParams.From
 		count.TimeTo = sanitizedQueryParams.To
 	}
 
-	return count
+	return count, err
+}
+
+// A count for one value of the grouped field in one period (see EachGroupedCount)
+type ResultGroupedCount struct {
+	Bucket int    `db:"bucket"`
+	Value  string `db:"value"`
+	Count  int    `db:"count"`
+}
+
+// Group by column names go straight into the query, so unlike the other params they must be nothing but a column name
+var groupFieldPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// The columns of each series (table), looked up once
+var seriesColumns = struct {
+	sync.Mutex
+	columns map[string][]string
+}{columns: map[string][]string{}}
+
+// Returns whether the series has the given column. Without Postgres there's nothing to check against, so any column is fine.
+func (database *SocialHarvestDB) HasColumn(series string, column string) (bool, error) {
+	if db.Postgres == nil {
+		return true, nil
+	}
+	seriesColumns.Lock()
+	defer seriesColumns.Unlock()
+	columns, ok := seriesColumns.columns[series]
+	if !ok {
+		err := db.Postgres.Select(&columns, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", series)
+		if err != nil {
+			return false, err
+		}
+		seriesColumns.columns[series] = columns
+	}
+	return stringInSlice(column, columns), nil
+}
+
+// Counts a series for each value of groupField in each period, all in one query. The periods are given by their boundaries
+// (each period's start and then the end of the last one). Either the values to count are given or, when values is empty,
+// the top values (by count over the whole range) are used. The field/fieldValue and network params still filter (unless
+// that's what's being grouped by). fn is called with every period and value in order (by period, then by the order of the
+// values or their rank), with a count of 0 where there was nothing, so results can be streamed out as they're read.
+// Without a groupField there's just the one series (with an empty value), which is how a plain timeseries is counted.
+func (database *SocialHarvestDB) EachGroupedCount(queryParams CommonQueryParams, fieldValue string, groupField string, values []string, top int, boundaries []time.Time, fn func(ResultGroupedCount) error) error {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	if db.Postgres == nil || sanitizedQueryParams.Territory == "" || sanitizedQueryParams.Series == "" || len(boundaries) < 2 {
+		return nil
+	}
+	if groupField != "" && !groupFieldPattern.MatchString(groupField) {
+		return errors.New("Invalid group field: " + groupField)
+	}
+	value := "CAST('' AS text)"
+	if groupField != "" {
+		value = "CAST(" + groupField + " AS text)"
+	}
+
+	args := []interface{}{sanitizedQueryParams.Territory}
+	// Conditions shared by the counts and the top values
+	var conditions bytes.Buffer
+	conditions.WriteString(" FROM ")
+	conditions.WriteString(sanitizedQueryParams.Series)
+	conditions.WriteString(" WHERE territory = $1 AND time >= '")
+	conditions.WriteString(boundaries[0].UTC().Format(dbTimeFormat))
+	conditions.WriteString("' AND time <= '")
+	conditions.WriteString(boundaries[len(boundaries)-1].UTC().Format(dbTimeFormat))
+	conditions.WriteString("'")
+	if sanitizedQueryParams.Field != "" && fieldValue != "" && sanitizedQueryParams.Field != groupField && groupFieldPattern.MatchString(sanitizedQueryParams.Field) {
+		args = append(args, fieldValue)
+		conditions.WriteString(" AND ")
+		conditions.WriteString(sanitizedQueryParams.Field)
+		conditions.WriteString(" = $")
+		conditions.WriteString(strconv.Itoa(len(args)))
+	}
+	if sanitizedQueryParams.Network != "" && groupField != "network" {
+		args = append(args, sanitizedQueryParams.Network)
+		conditions.WriteString(" AND network = $")
+		conditions.WriteString(strconv.Itoa(len(args)))
+	}
+
+	bounds := []string{}
+	for _, b := range boundaries {
+		bounds = append(bounds, b.UTC().Format(dbTimeFormat))
+	}
+	args = append(args, pq.Array(bounds))
+	boundsArg := "$" + strconv.Itoa(len(args)) + "::timestamp[]"
+	periods := strconv.Itoa(len(boundaries) - 1)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("WITH vals AS (")
+	if groupField == "" {
+		buffer.WriteString("SELECT CAST('' AS text) AS value, 1 AS rank")
+	} else if len(values) > 0 {
+		args = append(args, pq.Array(values))
+		buffer.WriteString("SELECT value, rank FROM unnest($")
+		buffer.WriteString(strconv.Itoa(len(args)))
+		buffer.WriteString("::text[]) WITH ORDINALITY AS v(value, rank)")
+	} else {
+		buffer.WriteString("SELECT ")
+		buffer.WriteString(value)
+		buffer.WriteString(" AS value, row_number() OVER (ORDER BY COUNT(*) DESC, ")
+		buffer.WriteString(value)
+		buffer.WriteString(") AS rank")
+		buffer.WriteString(conditions.String())
+		buffer.WriteString(" AND ")
+		buffer.WriteString(groupField)
+		buffer.WriteString(" IS NOT NULL GROUP BY ")
+		buffer.WriteString(groupField)
+		buffer.WriteString(" ORDER BY rank LIMIT ")
+		buffer.WriteString(strconv.Itoa(top))
+	}
+	buffer.WriteString("), counts AS (SELECT LEAST(width_bucket(time, ")
+	buffer.WriteString(boundsArg)
+	buffer.WriteString("), ")
+	buffer.WriteString(periods)
+	// The end of the range is included (as it is for Count), so anything right on it goes in the last period
+	buffer.WriteString(") AS bucket, ")
+	buffer.WriteString(value)
+	buffer.WriteString(" AS value, COUNT(*) AS count")
+	buffer.WriteString(conditions.String())
+	if groupField != "" {
+		buffer.WriteString(" AND ")
+		buffer.WriteString(value)
+		buffer.WriteString(" IN (SELECT value FROM vals)")
+	}
+	buffer.WriteString(" GROUP BY 1, 2)")
+	buffer.WriteString(" SELECT i AS bucket, vals.value, COALESCE(counts.count, 0) AS count FROM generate_series(1, ")
+	buffer.WriteString(periods)
+	buffer.WriteString(") AS i CROSS JOIN vals LEFT JOIN counts ON counts.bucket = i AND counts.value = vals.value ORDER BY i, vals.rank")
+
+	rows, err := db.Postgres.Queryx(buffer.String(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var count ResultGroupedCount
+		if err = rows.StructScan(&count); err != nil {
+			return err
+		}
+		if err = fn(count); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
 // Allows the messages series to be queried in some general ways.
@@ -473,60 +669,8 @@ func (database *SocialHarvestDB) Messages(queryParams CommonQueryParams, conds B
 	bufferCount.WriteString("SELECT COUNT(*)")
 	bufferQuery.WriteString("SELECT *")
 
-	buffer.WriteString(" FROM messages WHERE territory = '")
-	buffer.WriteString(sanitizedQueryParams.Territory)
-	buffer.WriteString("'")
-
-	// optional date range (can have either or both)
-	if sanitizedQueryParams.From != "" {
-		buffer.WriteString(" AND time >= ")
-		buffer.WriteString(sanitizedQueryParams.From)
-	}
-	if sanitizedQueryParams.To != "" {
-		buffer.WriteString(" AND time <= ")
-		buffer.WriteString(sanitizedQueryParams.To)
-	}
-	if sanitizedQueryParams.Network != "" {
-		buffer.WriteString(" AND network = ")
-		buffer.WriteString(sanitizedQueryParams.Network)
-	}
-
-	// BasicConditions (various basic query conditions to be used explicitly, not in a loop, because not all fields will be available depending on the series)
-	if conds.Lang != "" {
-		buffer.WriteString(" AND contributor_lang = ")
-		buffer.WriteString(conds.Lang)
-	}
-	if conds.Country != "" {
-		buffer.WriteString(" AND contributor_country = ")
-		buffer.WriteString(conds.Country)
-	}
-	if conds.Geohash != "" {
-		// Ensure the goehash is alphanumeric.
-		// TODO: Pass these conditions through a sanitizer too, though the ORM should use prepared statements and take care of SQL injection....right? TODO: Check that too.
-		pattern := `(?i)[A-z0-9]`
-		r, _ := regexp.Compile(pattern)
-		if r.MatchString(conds.Geohash) {
-			buffer.WriteString(" AND contributor_geohash LIKE ")
-			buffer.WriteString(conds.Geohash)
-			buffer.WriteString("%")
-		}
-	}
-	if conds.Gender != "" {
-		switch conds.Gender {
-		case "-1", "f", "female":
-			buffer.WriteString(" AND contributor_gender = -1")
-			break
-		case "1", "m", "male":
-			buffer.WriteString(" AND contributor_gender = 1")
-			break
-		case "0", "u", "unknown":
-			buffer.WriteString(" AND contributor_gender = 0")
-			break
-		}
-	}
-	if conds.IsQuestion != 0 {
-		buffer.WriteString(" AND is_question = 1")
-	}
+	conditions, args := messagesConditions(sanitizedQueryParams, conds)
+	buffer.WriteString(conditions)
 
 	// Count here (before limit and order)
 	bufferCount.WriteString(buffer.String())
@@ -556,7 +700,7 @@ func (database *SocialHarvestDB) Messages(queryParams CommonQueryParams, conds B
 
 	if db.Postgres != nil {
 		var rows *sqlx.Rows
-		rows, err = db.Postgres.Queryx(query)
+		rows, err = db.Postgres.Queryx(query, args...)
 		if err != nil {
 			log.Println(err)
 			return results, 0, sanitizedQueryParams.Skip, sanitizedQueryParams.Limit
@@ -573,7 +717,7 @@ func (database *SocialHarvestDB) Messages(queryParams CommonQueryParams, conds B
 			results = append(results, msg)
 		}
 
-		err = db.Postgres.Get(&total, countQuery)
+		err = db.Postgres.Get(&total, countQuery, args...)
 		if err != nil {
 			log.Println(err)
 		}
@@ -581,3 +725,930 @@ func (database *SocialHarvestDB) Messages(queryParams CommonQueryParams, conds B
 
 	return results, total, sanitizedQueryParams.Skip, sanitizedQueryParams.Limit
 }
+
+// Returns the FROM and WHERE clause (and its args) used to query the messages series for a territory with the given params and conditions.
+// The params must already be sanitized.
+func messagesConditions(sanitizedQueryParams CommonQueryParams, conds BasicConditions) (string, []interface{}) {
+	args := []interface{}{sanitizedQueryParams.Territory}
+	var buffer bytes.Buffer
+	buffer.WriteString(" FROM messages WHERE territory = $1")
+
+	// optional date range (can have either or both)
+	if sanitizedQueryParams.From != "" {
+		buffer.WriteString(" AND time >= '")
+		buffer.WriteString(sanitizedQueryParams.From)
+		buffer.WriteString("'")
+	}
+	if sanitizedQueryParams.To != "" {
+		buffer.WriteString(" AND time <= '")
+		buffer.WriteString(sanitizedQueryParams.To)
+		buffer.WriteString("'")
+	}
+	if sanitizedQueryParams.Network != "" {
+		args = append(args, sanitizedQueryParams.Network)
+		buffer.WriteString(" AND network = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+
+	// BasicConditions (various basic query conditions to be used explicitly, not in a loop, because not all fields will be available depending on the series)
+	args = appendBasicConditions(&buffer, conds, args)
+
+	return buffer.String(), args
+}
+
+// How many messages are read from the database at a time when walking the whole series
+const messagesBatchSize = 1000
+
+// Walks every message for a territory matching the params and conditions (oldest first), calling fn with each batch.
+// Rather than OFFSET (which gets slower the further in you go) this keeps a cursor on the last (time, network, message_id) seen,
+// so only one batch is ever held in memory no matter how large the range is. Returning an error from fn stops the walk.
+func (database *SocialHarvestDB) EachMessages(queryParams CommonQueryParams, conds BasicConditions, fn func([]config.SocialHarvestMessage) error) error {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+
+	// Must have a territory (for now)
+	if sanitizedQueryParams.Territory == "" || db.Postgres == nil {
+		return nil
+	}
+
+	conditions, args := messagesConditions(sanitizedQueryParams, conds)
+	var last *config.SocialHarvestMessage
+	for {
+		var buffer bytes.Buffer
+		buffer.WriteString("SELECT *")
+		buffer.WriteString(conditions)
+		batchArgs := args
+		if last != nil {
+			batchArgs = append(append([]interface{}{}, args...), last.Time, last.Network, last.MessageId)
+			buffer.WriteString(" AND (time, network, message_id) > ($")
+			buffer.WriteString(strconv.Itoa(len(batchArgs) - 2))
+			buffer.WriteString(", $")
+			buffer.WriteString(strconv.Itoa(len(batchArgs) - 1))
+			buffer.WriteString(", $")
+			buffer.WriteString(strconv.Itoa(len(batchArgs)))
+			buffer.WriteString(")")
+		}
+		buffer.WriteString(" ORDER BY time ASC, network ASC, message_id ASC LIMIT ")
+		buffer.WriteString(strconv.Itoa(messagesBatchSize))
+
+		batch := []config.SocialHarvestMessage{}
+		err := db.Postgres.Select(&batch, buffer.String(), batchArgs...)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+		if len(batch) < messagesBatchSize {
+			return nil
+		}
+		last = &batch[len(batch)-1]
+	}
+}
+
+// Appends BasicConditions to a query using placeholders (the values are user input), returning the args to pass along with the query.
+// Not every series has all of these fields, so it's really meant for the messages series.
+func appendBasicConditions(buffer *bytes.Buffer, conds BasicConditions, args []interface{}) []interface{} {
+	if conds.Lang != "" {
+		args = append(args, conds.Lang)
+		buffer.WriteString(" AND contributor_lang = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	if conds.Country != "" {
+		args = append(args, conds.Country)
+		buffer.WriteString(" AND contributor_country = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	if conds.Geohash != "" {
+		args = append(args, conds.Geohash+"%")
+		buffer.WriteString(" AND contributor_geohash LIKE $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	switch conds.Gender {
+	case "-1", "f", "female":
+		buffer.WriteString(" AND contributor_gender = -1")
+	case "1", "m", "male":
+		buffer.WriteString(" AND contributor_gender = 1")
+	case "0", "u", "unknown":
+		buffer.WriteString(" AND contributor_gender = 0")
+	}
+	if conds.IsQuestion != 0 {
+		buffer.WriteString(" AND is_question = 1")
+	}
+	if conds.ContributorId != "" {
+		args = append(args, conds.ContributorId)
+		buffer.WriteString(" AND contributor_id = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+	}
+	return args
+}
+
+// Engagement on the messages series is spread across a few network specific columns.
+const (
+	messageLikesSQL  = "COALESCE(twitter_favorite_count, 0)"
+	messageSharesSQL = "COALESCE(facebook_shares, 0) + COALESCE(twitter_retweet_count, 0)"
+)
+
+type ResultHeatmap struct {
+	// Indexed by day of week (0 is Sunday) and then by hour of day
+	Counts     [][]int `json:"counts"`
+	Engagement [][]int `json:"engagement,omitempty"`
+	Timezone   string  `json:"timezone"`
+	Total      int     `json:"total"`
+	TimeFrom   string  `json:"timeFrom"`
+	TimeTo     string  `json:"timeTo"`
+}
+
+// Buckets the messages for a territory by day of week and hour of day in the given timezone (an IANA name, which should be validated before calling).
+// Optionally sums engagement (likes and shares) for each bucket as well.
+func (database *SocialHarvestDB) ActivityHeatmap(queryParams CommonQueryParams, conds BasicConditions, timezone string, engagement bool) ResultHeatmap {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	var heatmap = ResultHeatmap{
+		Counts:   make([][]int, 7),
+		Timezone: timezone,
+		TimeFrom: sanitizedQueryParams.From,
+		TimeTo:   sanitizedQueryParams.To,
+	}
+	for d := range heatmap.Counts {
+		heatmap.Counts[d] = make([]int, 24)
+	}
+	if engagement {
+		heatmap.Engagement = make([][]int, 7)
+		for d := range heatmap.Engagement {
+			heatmap.Engagement[d] = make([]int, 24)
+		}
+	}
+
+	if sanitizedQueryParams.Territory == "" {
+		return heatmap
+	}
+
+	if db.Postgres != nil {
+		// Times are stored in UTC (without a zone) so they need to be converted before extracting the day and hour.
+		args := []interface{}{timezone}
+		localTime := "((time AT TIME ZONE 'UTC') AT TIME ZONE $1)"
+
+		var buffer bytes.Buffer
+		buffer.WriteString("SELECT CAST(EXTRACT(DOW FROM ")
+		buffer.WriteString(localTime)
+		buffer.WriteString(") AS INTEGER) AS dow, CAST(EXTRACT(HOUR FROM ")
+		buffer.WriteString(localTime)
+		buffer.WriteString(") AS INTEGER) AS hour, COUNT(*) AS count")
+		if engagement {
+			buffer.WriteString(", COALESCE(SUM(")
+			buffer.WriteString(messageLikesSQL)
+			buffer.WriteString(" + ")
+			buffer.WriteString(messageSharesSQL)
+			buffer.WriteString("), 0) AS engagement")
+		} else {
+			buffer.WriteString(", 0 AS engagement")
+		}
+		args = append(args, sanitizedQueryParams.Territory)
+		buffer.WriteString(" FROM messages WHERE territory = $")
+		buffer.WriteString(strconv.Itoa(len(args)))
+
+		// optional date range (can have either or both)
+		if sanitizedQueryParams.From != "" {
+			buffer.WriteString(" AND time >= '")
+			buffer.WriteString(sanitizedQueryParams.From)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.To != "" {
+			buffer.WriteString(" AND time <= '")
+			buffer.WriteString(sanitizedQueryParams.To)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
+			buffer.WriteString(" AND network = $")
+			buffer.WriteString(strconv.Itoa(len(args)))
+		}
+		args = appendBasicConditions(&buffer, conds, args)
+
+		buffer.WriteString(" GROUP BY dow, hour")
+
+		query := buffer.String()
+		buffer.Reset()
+
+		var buckets []struct {
+			Dow        int `db:"dow"`
+			Hour       int `db:"hour"`
+			Count      int `db:"count"`
+			Engagement int `db:"engagement"`
+		}
+		err := db.Postgres.Select(&buckets, query, args...)
+		if err != nil {
+			log.Println(err)
+			return heatmap
+		}
+
+		for _, b := range buckets {
+			if b.Dow < 0 || b.Dow > 6 || b.Hour < 0 || b.Hour > 23 {
+				continue
+			}
+			heatmap.Counts[b.Dow][b.Hour] = b.Count
+			heatmap.Total += b.Count
+			if engagement {
+				heatmap.Engagement[b.Dow][b.Hour] = b.Engagement
+			}
+		}
+	}
+
+	return heatmap
+}
+
+type ResultContributor struct {
+	Network        string `json:"network" db:"network"`
+	ContributorId  string `json:"contributor_id" db:"contributor_id"`
+	ScreenName     string `json:"contributor_screen_name" db:"contributor_screen_name"`
+	Name           string `json:"contributor_name" db:"contributor_name"`
+	Gender         int    `json:"contributor_gender" db:"contributor_gender"`
+	Type           string `json:"contributor_type" db:"contributor_type"`
+	Lang           string `json:"contributor_lang" db:"contributor_lang"`
+	Country        string `json:"contributor_country" db:"contributor_country"`
+	City           string `json:"contributor_city" db:"contributor_city"`
+	Region         string `json:"contributor_region" db:"contributor_region"`
+	Followers      int    `json:"contributor_followers" db:"contributor_followers"`
+	Following      int    `json:"contributor_following" db:"contributor_following"`
+	StatusesCount  int    `json:"contributor_statuses_count" db:"contributor_statuses_count"`
+	Verified       int    `json:"contributor_verified" db:"contributor_verified"`
+	MessageCount   int    `json:"message_count" db:"message_count"`
+	Likes          int    `json:"likes" db:"likes"`
+	Shares         int    `json:"shares" db:"shares"`
+	Engagement     int    `json:"engagement" db:"engagement"`
+	FirstMessageAt string `json:"first_message_at" db:"first_message_at"`
+	LastMessageAt  string `json:"last_message_at" db:"last_message_at"`
+}
+
+// Ways to rank contributors and the ORDER BY each one maps to (ties end up ordered by contributor so pages don't shift)
+var contributorSortOrders = map[string]string{
+	"messages":   "message_count DESC, contributor_followers DESC, network, contributor_id",
+	"reach":      "contributor_followers DESC, message_count DESC, network, contributor_id",
+	"engagement": "engagement DESC, message_count DESC, network, contributor_id",
+}
+
+// Returns the top contributors for a territory from the messages series ranked by message count, reach (followers) or engagement (likes and shares).
+// Profile fields are taken from the contributor's messages in the range (the largest value wins when they changed over time).
+func (database *SocialHarvestDB) TopContributors(queryParams CommonQueryParams, conds BasicConditions, sortBy string) ([]ResultContributor, int) {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	var results = []ResultContributor{}
+	var distinct int
+
+	if sanitizedQueryParams.Territory == "" {
+		return results, 0
+	}
+	orderBy, ok := contributorSortOrders[sortBy]
+	if !ok {
+		orderBy = contributorSortOrders["messages"]
+	}
+
+	if db.Postgres != nil {
+		var err error
+		args := []interface{}{sanitizedQueryParams.Territory}
+
+		var buffer bytes.Buffer
+		buffer.WriteString(" FROM messages WHERE territory = $1 AND contributor_id != ''")
+
+		// optional date range (can have either or both)
+		if sanitizedQueryParams.From != "" {
+			buffer.WriteString(" AND time >= '")
+			buffer.WriteString(sanitizedQueryParams.From)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.To != "" {
+			buffer.WriteString(" AND time <= '")
+			buffer.WriteString(sanitizedQueryParams.To)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
+			buffer.WriteString(" AND network = $")
+			buffer.WriteString(strconv.Itoa(len(args)))
+		}
+		args = appendBasicConditions(&buffer, conds, args)
+		conditions := buffer.String()
+		buffer.Reset()
+
+		buffer.WriteString("SELECT network, contributor_id")
+		buffer.WriteString(", MAX(contributor_screen_name) AS contributor_screen_name")
+		buffer.WriteString(", MAX(contributor_name) AS contributor_name")
+		buffer.WriteString(", MAX(contributor_gender) AS contributor_gender")
+		buffer.WriteString(", MAX(contributor_type) AS contributor_type")
+		buffer.WriteString(", MAX(contributor_lang) AS contributor_lang")
+		buffer.WriteString(", MAX(contributor_country) AS contributor_country")
+		buffer.WriteString(", MAX(contributor_city) AS contributor_city")
+		buffer.WriteString(", MAX(contributor_region) AS contributor_region")
+		buffer.WriteString(", COALESCE(MAX(contributor_followers), 0) AS contributor_followers")
+		buffer.WriteString(", COALESCE(MAX(contributor_following), 0) AS contributor_following")
+		buffer.WriteString(", COALESCE(MAX(contributor_statuses_count), 0) AS contributor_statuses_count")
+		buffer.WriteString(", COALESCE(MAX(contributor_verified), 0) AS contributor_verified")
+		buffer.WriteString(", COUNT(*) AS message_count")
+		buffer.WriteString(", COALESCE(SUM(")
+		buffer.WriteString(messageLikesSQL)
+		buffer.WriteString("), 0) AS likes")
+		buffer.WriteString(", COALESCE(SUM(")
+		buffer.WriteString(messageSharesSQL)
+		buffer.WriteString("), 0) AS shares")
+		buffer.WriteString(", COALESCE(SUM(")
+		buffer.WriteString(messageLikesSQL)
+		buffer.WriteString(" + ")
+		buffer.WriteString(messageSharesSQL)
+		buffer.WriteString("), 0) AS engagement")
+		buffer.WriteString(", CAST(MIN(time) AS TEXT) AS first_message_at")
+		buffer.WriteString(", CAST(MAX(time) AS TEXT) AS last_message_at")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" GROUP BY network, contributor_id")
+		buffer.WriteString(" ORDER BY ")
+		buffer.WriteString(orderBy)
+
+		if sanitizedQueryParams.Limit > 0 {
+			buffer.WriteString(" LIMIT ")
+			buffer.WriteString(strconv.FormatUint(sanitizedQueryParams.Limit, 10))
+		}
+		if sanitizedQueryParams.Skip > 0 {
+			buffer.WriteString(" OFFSET ")
+			buffer.WriteString(strconv.FormatUint(sanitizedQueryParams.Skip, 10))
+		}
+
+		query := buffer.String()
+		buffer.Reset()
+		err = db.Postgres.Select(&results, query, args...)
+		if err != nil {
+			log.Println(err)
+		}
+
+		// How many different contributors there were in total (for paging)
+		buffer.WriteString("SELECT COUNT(DISTINCT (network, contributor_id))")
+		buffer.WriteString(conditions)
+		query = buffer.String()
+		buffer.Reset()
+		err = db.Postgres.Get(&distinct, query, args...)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return results, distinct
+}
+
+type ResultContributorProfile struct {
+	Profile          *ResultContributor                     `json:"profile"`
+	Volume           []ResultAggregateCount                 `json:"volume"`
+	Hashtags         []ResultAggregateCount                 `json:"hashtags"`
+	Links            []ResultAggregateCount                 `json:"links"`
+	MentionsMade     int                                    `json:"mentionsMade"`
+	MentionsReceived int                                    `json:"mentionsReceived"`
+	Growth           *config.SocialHarvestContributorGrowth `json:"growth"`
+	TimeFrom         string                                 `json:"timeFrom"`
+	TimeTo           string                                 `json:"timeTo"`
+}
+
+// Returns everything we know about a single contributor within a territory: profile data and totals from the messages series,
+// message volume per day, top hashtags and shared links, mention counts (made and received) and the latest contributor_growth stats.
+// The contributor's messages themselves can be paged through with Messages() using the ContributorId condition.
+func (database *SocialHarvestDB) ContributorProfile(queryParams CommonQueryParams, contributorId string) ResultContributorProfile {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	var profile = ResultContributorProfile{
+		Volume:   []ResultAggregateCount{},
+		Hashtags: []ResultAggregateCount{},
+		Links:    []ResultAggregateCount{},
+		TimeFrom: sanitizedQueryParams.From,
+		TimeTo:   sanitizedQueryParams.To,
+	}
+
+	if sanitizedQueryParams.Territory == "" || sanitizedQueryParams.Network == "" || contributorId == "" {
+		return profile
+	}
+
+	// Profile data and totals come from the same query used to rank contributors
+	contributors, _ := database.TopContributors(CommonQueryParams{
+		Territory: sanitizedQueryParams.Territory,
+		Network:   sanitizedQueryParams.Network,
+		From:      sanitizedQueryParams.From,
+		To:        sanitizedQueryParams.To,
+		Limit:     1,
+	}, BasicConditions{ContributorId: contributorId}, "messages")
+	if len(contributors) > 0 {
+		profile.Profile = &contributors[0]
+	}
+
+	if db.Postgres != nil {
+		var err error
+		// $1, $2 and $3 are the network, contributor and territory for every query below
+		args := []interface{}{sanitizedQueryParams.Network, contributorId, sanitizedQueryParams.Territory}
+
+		var buffer bytes.Buffer
+		buffer.WriteString(" WHERE territory = $3 AND network = $1")
+		// optional date range (can have either or both)
+		if sanitizedQueryParams.From != "" {
+			buffer.WriteString(" AND time >= '")
+			buffer.WriteString(sanitizedQueryParams.From)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.To != "" {
+			buffer.WriteString(" AND time <= '")
+			buffer.WriteString(sanitizedQueryParams.To)
+			buffer.WriteString("'")
+		}
+		conditions := buffer.String()
+		buffer.Reset()
+
+		// Message volume per day
+		buffer.WriteString("SELECT COUNT(*) AS count, CAST(CAST(date_trunc('day', ")
+		buffer.WriteString(localTimeColumn(sanitizedQueryParams))
+		buffer.WriteString(") AS DATE) AS TEXT) AS value FROM messages")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" AND contributor_id = $2 GROUP BY value ORDER BY value ASC")
+		err = db.Postgres.Select(&profile.Volume, buffer.String(), args...)
+		buffer.Reset()
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Top hashtags used
+		buffer.WriteString("SELECT COUNT(*) AS count, LOWER(tag) AS value FROM hashtags")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" AND contributor_id = $2 AND tag != '' GROUP BY value ORDER BY count DESC LIMIT 10")
+		err = db.Postgres.Select(&profile.Hashtags, buffer.String(), args...)
+		buffer.Reset()
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Top links shared
+		buffer.WriteString("SELECT COUNT(*) AS count, expanded_url AS value FROM shared_links")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" AND contributor_id = $2 AND expanded_url != '' GROUP BY value ORDER BY count DESC LIMIT 10")
+		err = db.Postgres.Select(&profile.Links, buffer.String(), args...)
+		buffer.Reset()
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Mentions in both directions
+		buffer.WriteString("SELECT COUNT(*) FROM mentions")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" AND contributor_id = $2")
+		err = db.Postgres.Get(&profile.MentionsMade, buffer.String(), args...)
+		buffer.Reset()
+		if err != nil {
+			log.Println(err)
+		}
+		buffer.WriteString("SELECT COUNT(*) FROM mentions")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" AND mentioned_id = $2")
+		err = db.Postgres.Get(&profile.MentionsReceived, buffer.String(), args...)
+		buffer.Reset()
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Latest follower stats (not limited by the date range, the most recent is always wanted)
+		buffer.WriteString("SELECT * FROM contributor_growth WHERE territory = $3 AND network = $1 AND contributor_id = $2 ORDER BY time DESC LIMIT 1")
+		var growth config.SocialHarvestContributorGrowth
+		err = db.Postgres.QueryRowx(buffer.String(), args...).StructScan(&growth)
+		buffer.Reset()
+		if err == nil {
+			profile.Growth = &growth
+		} else if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+	}
+
+	return profile
+}
+
+type ResultMessageDetail struct {
+	Message     config.SocialHarvestMessage      `json:"message"`
+	SharedLinks []config.SocialHarvestSharedLink `json:"shared_links"`
+	Hashtags    []config.SocialHarvestHashtag    `json:"hashtags"`
+	Mentions    []config.SocialHarvestMention    `json:"mentions"`
+}
+
+// Returns a single message from a territory along with the shared_links, hashtags and mentions that the harvester recorded for it.
+// The bool will be false if the message could not be found.
+func (database *SocialHarvestDB) MessageDetail(queryParams CommonQueryParams, messageId string) (ResultMessageDetail, bool) {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	var detail = ResultMessageDetail{
+		SharedLinks: []config.SocialHarvestSharedLink{},
+		Hashtags:    []config.SocialHarvestHashtag{},
+		Mentions:    []config.SocialHarvestMention{},
+	}
+
+	if sanitizedQueryParams.Territory == "" || messageId == "" {
+		return detail, false
+	}
+
+	if db.Postgres != nil {
+		var err error
+
+		// $1 and $2 are the territory and message id for every query below
+		conditions := " WHERE territory = $1 AND message_id = $2"
+
+		// Message ids are only unique per network (in theory the same message could also be harvested more than once, so take the latest)
+		var buffer bytes.Buffer
+		buffer.WriteString("SELECT * FROM messages")
+		buffer.WriteString(conditions)
+		args := []interface{}{sanitizedQueryParams.Territory, messageId}
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
+			buffer.WriteString(" AND network = $3")
+		}
+		buffer.WriteString(" ORDER BY time DESC LIMIT 1")
+		err = db.Postgres.QueryRowx(buffer.String(), args...).StructScan(&detail.Message)
+		buffer.Reset()
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println(err)
+			}
+			return detail, false
+		}
+
+		// The related records are matched on the network of the message found
+		args = []interface{}{sanitizedQueryParams.Territory, messageId, detail.Message.Network}
+		conditions = conditions + " AND network = $3 ORDER BY time ASC"
+
+		err = db.Postgres.Select(&detail.SharedLinks, "SELECT * FROM shared_links"+conditions, args...)
+		if err != nil {
+			log.Println(err)
+		}
+		err = db.Postgres.Select(&detail.Hashtags, "SELECT * FROM hashtags"+conditions, args...)
+		if err != nil {
+			log.Println(err)
+		}
+		err = db.Postgres.Select(&detail.Mentions, "SELECT * FROM mentions"+conditions, args...)
+		if err != nil {
+			log.Println(err)
+		}
+
+		return detail, true
+	}
+
+	return detail, false
+}
+
+// Audience overlap can be computed for up to this many territories at once (a Venn breakdown has 2^n-1 regions)
+const maxOverlapTerritories = 5
+
+type ResultOverlapRegion struct {
+	Territories []string `json:"territories"`
+	Count       int      `json:"count"`
+}
+
+type ResultOverlap struct {
+	Contributors map[string]int        `json:"contributors"`
+	Intersection int                   `json:"intersection"`
+	Union        int                   `json:"union"`
+	Jaccard      float64               `json:"jaccard"`
+	Regions      []ResultOverlapRegion `json:"regions"`
+}
+
+type ResultAudienceOverlap struct {
+	ResultOverlap
+	Territories []string                 `json:"territories"`
+	Networks    map[string]ResultOverlap `json:"networks"`
+	TimeFrom    string                   `json:"timeFrom"`
+	TimeTo      string                   `json:"timeTo"`
+}
+
+// Builds the overlap figures from the exclusive (Venn) regions, that is how many contributors were seen in exactly each combination of territories.
+func newResultOverlap(territories []string, regions []ResultOverlapRegion) ResultOverlap {
+	overlap := ResultOverlap{
+		Contributors: map[string]int{},
+		Regions:      regions,
+	}
+	for _, t := range territories {
+		overlap.Contributors[t] = 0
+	}
+	for _, region := range regions {
+		overlap.Union += region.Count
+		if len(region.Territories) == len(territories) {
+			overlap.Intersection += region.Count
+		}
+		for _, t := range region.Territories {
+			overlap.Contributors[t] += region.Count
+		}
+	}
+	if overlap.Union > 0 {
+		overlap.Jaccard = float64(overlap.Intersection) / float64(overlap.Union)
+	}
+	return overlap
+}
+
+// Compares the distinct contributors (by network and contributor id) of two or more territories in the messages series.
+// Returns the intersection, union and Jaccard index overall and per network along with a Venn ready breakdown of regions.
+// An error is returned when more than maxOverlapTerritories territories are given.
+func (database *SocialHarvestDB) AudienceOverlap(queryParams CommonQueryParams, territories []string) (ResultAudienceOverlap, error) {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	var overlap = ResultAudienceOverlap{
+		Territories: []string{},
+		Networks:    map[string]ResultOverlap{},
+		TimeFrom:    sanitizedQueryParams.From,
+		TimeTo:      sanitizedQueryParams.To,
+	}
+
+	// Territories are passed as query args so they only need to be unique
+	seen := map[string]bool{}
+	for _, t := range territories {
+		if t != "" && !seen[t] {
+			seen[t] = true
+			overlap.Territories = append(overlap.Territories, t)
+		}
+	}
+	sort.Strings(overlap.Territories)
+	overlap.ResultOverlap = newResultOverlap(overlap.Territories, []ResultOverlapRegion{})
+	if len(overlap.Territories) > maxOverlapTerritories {
+		return overlap, errors.New("Audience overlap can be computed for up to " + strconv.Itoa(maxOverlapTerritories) + " territories at once")
+	}
+	if len(overlap.Territories) < 2 {
+		return overlap, nil
+	}
+
+	if db.Postgres != nil {
+		args := []interface{}{}
+
+		var buffer bytes.Buffer
+		buffer.WriteString("SELECT network, territories, COUNT(*) AS count FROM (")
+		buffer.WriteString("SELECT network, contributor_id, array_agg(DISTINCT territory ORDER BY territory) AS territories FROM messages WHERE territory IN (")
+		for i, t := range overlap.Territories {
+			args = append(args, t)
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString("$")
+			buffer.WriteString(strconv.Itoa(len(args)))
+		}
+		buffer.WriteString(") AND contributor_id != ''")
+
+		// optional date range (can have either or both)
+		if sanitizedQueryParams.From != "" {
+			buffer.WriteString(" AND time >= '")
+			buffer.WriteString(sanitizedQueryParams.From)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.To != "" {
+			buffer.WriteString(" AND time <= '")
+			buffer.WriteString(sanitizedQueryParams.To)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
+			buffer.WriteString(" AND network = $")
+			buffer.WriteString(strconv.Itoa(len(args)))
+		}
+		buffer.WriteString(" GROUP BY network, contributor_id) AS contributors GROUP BY network, territories")
+
+		query := buffer.String()
+		buffer.Reset()
+
+		var rows []struct {
+			Network     string         `db:"network"`
+			Territories pq.StringArray `db:"territories"`
+			Count       int            `db:"count"`
+		}
+		err := db.Postgres.Select(&rows, query, args...)
+		if err != nil {
+			log.Println(err)
+			return overlap, nil
+		}
+
+		// Regions per network and overall (keyed by the territories joined, they come back sorted)
+		networkRegions := map[string][]ResultOverlapRegion{}
+		overallRegions := map[string]*ResultOverlapRegion{}
+		overallOrder := []string{}
+		for _, row := range rows {
+			region := ResultOverlapRegion{Territories: []string(row.Territories), Count: row.Count}
+			networkRegions[row.Network] = append(networkRegions[row.Network], region)
+
+			key := strings.Join(region.Territories, "\n")
+			if _, ok := overallRegions[key]; !ok {
+				overallRegions[key] = &ResultOverlapRegion{Territories: region.Territories}
+				overallOrder = append(overallOrder, key)
+			}
+			overallRegions[key].Count += row.Count
+		}
+
+		for network, regions := range networkRegions {
+			overlap.Networks[network] = newResultOverlap(overlap.Territories, regions)
+		}
+		regions := []ResultOverlapRegion{}
+		for _, key := range overallOrder {
+			regions = append(regions, *overallRegions[key])
+		}
+		overlap.ResultOverlap = newResultOverlap(overlap.Territories, regions)
+	}
+
+	return overlap, nil
+}
+
+type ResultCohort struct {
+	// The period the contributors in this cohort first posted in
+	Period string `json:"period"`
+	Size   int    `json:"size"`
+	// Active contributors and their percentage of the cohort for each period since (index 0 is the cohort's own period)
+	Active    []int     `json:"active"`
+	Retention []float64 `json:"retention"`
+}
+
+type ResultCohortPeriod struct {
+	Period    string `json:"period"`
+	New       int    `json:"new"`
+	Returning int    `json:"returning"`
+	Total     int    `json:"total"`
+}
+
+type ResultCohorts struct {
+	Interval string               `json:"interval"`
+	Cohorts  []ResultCohort       `json:"cohorts"`
+	Periods  []ResultCohortPeriod `json:"periods"`
+	TimeFrom string               `json:"timeFrom"`
+	TimeTo   string               `json:"timeTo"`
+}
+
+// Groups a territory's contributors (from the messages series) by the week or month of their first message and returns how many of
+// each cohort came back in later periods. Each period is also split into new and returning contributors.
+// Note that a contributor's first message is looked for across all time, not just the date range, so that "new" really means new.
+func (database *SocialHarvestDB) Cohorts(queryParams CommonQueryParams, interval string) ResultCohorts {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	if interval != "month" {
+		interval = "week"
+	}
+	var cohorts = ResultCohorts{
+		Interval: interval,
+		Cohorts:  []ResultCohort{},
+		Periods:  []ResultCohortPeriod{},
+		TimeFrom: sanitizedQueryParams.From,
+		TimeTo:   sanitizedQueryParams.To,
+	}
+
+	if sanitizedQueryParams.Territory == "" {
+		return cohorts
+	}
+
+	if db.Postgres != nil {
+		args := []interface{}{sanitizedQueryParams.Territory}
+		network := ""
+		if sanitizedQueryParams.Network != "" {
+			args = append(args, sanitizedQueryParams.Network)
+			network = " AND network = $2"
+		}
+
+		var buffer bytes.Buffer
+		// Each contributor's first period
+		buffer.WriteString("WITH firsts AS (SELECT network, contributor_id, date_trunc('")
+		buffer.WriteString(interval)
+		buffer.WriteString("', MIN(")
+		buffer.WriteString(localTimeColumn(sanitizedQueryParams))
+		buffer.WriteString(")) AS cohort FROM messages WHERE territory = $1 AND contributor_id != ''")
+		buffer.WriteString(network)
+		buffer.WriteString(" GROUP BY network, contributor_id), ")
+		// Each period a contributor was active in (within the date range)
+		buffer.WriteString("activity AS (SELECT DISTINCT network, contributor_id, date_trunc('")
+		buffer.WriteString(interval)
+		buffer.WriteString("', ")
+		buffer.WriteString(localTimeColumn(sanitizedQueryParams))
+		buffer.WriteString(") AS period FROM messages WHERE territory = $1 AND contributor_id != ''")
+		buffer.WriteString(network)
+		if sanitizedQueryParams.From != "" {
+			buffer.WriteString(" AND time >= '")
+			buffer.WriteString(sanitizedQueryParams.From)
+			buffer.WriteString("'")
+		}
+		if sanitizedQueryParams.To != "" {
+			buffer.WriteString(" AND time <= '")
+			buffer.WriteString(sanitizedQueryParams.To)
+			buffer.WriteString("'")
+		}
+		buffer.WriteString(") ")
+		buffer.WriteString("SELECT CAST(CAST(f.cohort AS DATE) AS TEXT) AS cohort, CAST(CAST(a.period AS DATE) AS TEXT) AS period, COUNT(*) AS count")
+		buffer.WriteString(" FROM activity a JOIN firsts f ON f.network = a.network AND f.contributor_id = a.contributor_id")
+		buffer.WriteString(" GROUP BY f.cohort, a.period ORDER BY f.cohort ASC, a.period ASC")
+
+		query := buffer.String()
+		buffer.Reset()
+
+		var rows []struct {
+			Cohort string `db:"cohort"`
+			Period string `db:"period"`
+			Count  int    `db:"count"`
+		}
+		err := db.Postgres.Select(&rows, query, args...)
+		if err != nil {
+			log.Println(err)
+			return cohorts
+		}
+
+		// Every period from the first seen to the last (dates as YYYY-MM-DD sort fine as strings), including any nobody was
+		// active in so that offsets line up
+		first, last := "", ""
+		for _, row := range rows {
+			if first == "" || row.Period < first {
+				first = row.Period
+			}
+			if row.Period > last {
+				last = row.Period
+			}
+		}
+		periods := cohortPeriods(first, last, interval)
+		periodIndex := map[string]int{}
+		for i, p := range periods {
+			periodIndex[p] = i
+			cohorts.Periods = append(cohorts.Periods, ResultCohortPeriod{Period: p})
+		}
+
+		// Only cohorts that started within the range get a retention row (their size is their activity in their own period)
+		cohortIndex := map[string]int{}
+		for _, row := range rows {
+			i := periodIndex[row.Period]
+			if row.Cohort == row.Period {
+				cohorts.Periods[i].New += row.Count
+				cohortIndex[row.Cohort] = len(cohorts.Cohorts)
+				cohorts.Cohorts = append(cohorts.Cohorts, ResultCohort{
+					Period:    row.Cohort,
+					Size:      row.Count,
+					Active:    make([]int, len(periods)-i),
+					Retention: make([]float64, len(periods)-i),
+				})
+			} else {
+				cohorts.Periods[i].Returning += row.Count
+			}
+			cohorts.Periods[i].Total += row.Count
+		}
+		for _, row := range rows {
+			c, ok := cohortIndex[row.Cohort]
+			if !ok {
+				continue
+			}
+			offset := periodIndex[row.Period] - periodIndex[row.Cohort]
+			if offset >= 0 && offset < len(cohorts.Cohorts[c].Active) {
+				cohorts.Cohorts[c].Active[offset] = row.Count
+				cohorts.Cohorts[c].Retention[offset] = float64(row.Count) / float64(cohorts.Cohorts[c].Size) * 100
+			}
+		}
+	}
+
+	return cohorts
+}
+
+// Returns the start of each week (or month) from first to last, both given as YYYY-MM-DD
+func cohortPeriods(first string, last string, interval string) []string {
+	periods := []string{}
+	start, err := time.Parse("2006-01-02", first)
+	if err != nil {
+		return periods
+	}
+	finish, err := time.Parse("2006-01-02", last)
+	if err != nil {
+		return periods
+	}
+	for t := start; !t.After(finish); {
+		periods = append(periods, t.Format("2006-01-02"))
+		if interval == "month" {
+			t = t.AddDate(0, 1, 0)
+		} else {
+			t = t.AddDate(0, 0, 7)
+		}
+	}
+	return periods
+}
+
+// Returns the number of messages for a territory per day (or "hour", "week", "month") in a single query, oldest first.
+// The value of each count is the start of the period.
+func (database *SocialHarvestDB) MessageVolume(queryParams CommonQueryParams, conds BasicConditions, interval string) []ResultAggregateCount {
+	sanitizedQueryParams := SanitizeCommonQueryParams(queryParams)
+	var volume = []ResultAggregateCount{}
+
+	switch interval {
+	case "hour", "day", "week", "month":
+	default:
+		interval = "day"
+	}
+	if sanitizedQueryParams.Territory == "" {
+		return volume
+	}
+
+	if db.Postgres != nil {
+		conditions, args := messagesConditions(sanitizedQueryParams, conds)
+
+		var buffer bytes.Buffer
+		buffer.WriteString("SELECT COUNT(*) AS count, CAST(date_trunc('")
+		buffer.WriteString(interval)
+		buffer.WriteString("', ")
+		buffer.WriteString(localTimeColumn(sanitizedQueryParams))
+		buffer.WriteString(") AS TEXT) AS value")
+		buffer.WriteString(conditions)
+		buffer.WriteString(" GROUP BY value ORDER BY value ASC")
+
+		err := db.Postgres.Select(&volume, buffer.String(), args...)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return volume
+}
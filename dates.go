@@ -0,0 +1,255 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the handling of the date range (from, to) and timezone (tz) params shared by the API routes.
+// Everything is stored in UTC, so dates given in another timezone are converted before they're used in a query.
+//
+// Dates can be plain dates (2014-10-01), dates and times (2014-10-01 12:00), RFC 3339 times (2014-10-01T12:00:00Z)
+// or relative to now: "now", "now-7d", "now-1h30m" (units are s, m, h, d, w, M for months and y) and the names of periods:
+// today, yesterday, this-week, last-week, this-month, last-month, this-year and last-year. Weeks start on Monday.
+// A period as the "from" means the start of it and as the "to" the end of it. A period on its own covers the whole period.
+package main
+
+import (
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The format the database is queried with (always UTC)
+const dbTimeFormat = "2006-01-02 15:04:05"
+
+// Dates without a zone are read in the requested timezone
+var dateRangeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+var (
+	// Offsets without a sign take the one before them, so now-1h30m is an hour and a half ago
+	relativeDatePattern   = regexp.MustCompile(`^now((?:[+-][0-9]+[smhdwMy](?:[0-9]+[smhdwMy])*)*)$`)
+	relativeOffsetPattern = regexp.MustCompile(`([+-]?)([0-9]+)([smhdwMy])`)
+)
+
+const dateHelp = "use a date (2014-10-01), a time (2014-10-01 12:00 or 2014-10-01T12:00:00Z) or a relative date (now-7d, today, this-week, last-month)"
+
+// A date range from the querystring
+type dateRange struct {
+	// What the database is queried with (UTC)
+	From string
+	To   string
+	// The requested timezone (UTC by default)
+	Location *time.Location
+	// The parsed times (zero when not given)
+	from time.Time
+	to   time.Time
+}
+
+// Returns the start and end of a named period (today, last-week, etc.), false if it isn't one
+func datePeriod(name string, now time.Time) (time.Time, time.Time, bool) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Monday is the first day of the week
+	weekday := (int(today.Weekday()) + 6) % 7
+	thisWeek := today.AddDate(0, 0, -weekday)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	thisYear := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+
+	switch name {
+	case "today":
+		return today, today.AddDate(0, 0, 1), true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, true
+	case "this-week":
+		return thisWeek, thisWeek.AddDate(0, 0, 7), true
+	case "last-week":
+		return thisWeek.AddDate(0, 0, -7), thisWeek, true
+	case "this-month":
+		return thisMonth, thisMonth.AddDate(0, 1, 0), true
+	case "last-month":
+		return thisMonth.AddDate(0, -1, 0), thisMonth, true
+	case "this-year":
+		return thisYear, thisYear.AddDate(1, 0, 0), true
+	case "last-year":
+		return thisYear.AddDate(-1, 0, 0), thisYear, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// Reads a date (see above) in the given timezone. For periods, end decides whether the start or end of the period is returned.
+func parseDate(value string, loc *time.Location, now time.Time, end bool) (time.Time, error) {
+	now = now.In(loc)
+	value = strings.TrimSpace(value)
+
+	// A "+" in a querystring that wasn't encoded comes through as a space
+	if strings.HasPrefix(value, "now") || strings.Contains(value, "T") {
+		value = strings.Replace(value, " ", "+", -1)
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+	for _, layout := range dateRangeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	if start, finish, ok := datePeriod(value, now); ok {
+		if end {
+			return finish, nil
+		}
+		return start, nil
+	}
+
+	if relativeDatePattern.MatchString(value) {
+		t := now
+		sign := ""
+		for _, offset := range relativeOffsetPattern.FindAllStringSubmatch(value, -1) {
+			n, err := strconv.Atoi(offset[2])
+			if err != nil || n > 100000 {
+				return time.Time{}, errors.New("the offset " + offset[0] + " is too large")
+			}
+			if offset[1] != "" {
+				sign = offset[1]
+			}
+			if sign == "-" {
+				n = -n
+			}
+			switch offset[3] {
+			case "s":
+				t = t.Add(time.Duration(n) * time.Second)
+			case "m":
+				t = t.Add(time.Duration(n) * time.Minute)
+			case "h":
+				t = t.Add(time.Duration(n) * time.Hour)
+			case "d":
+				t = t.AddDate(0, 0, n)
+			case "w":
+				t = t.AddDate(0, 0, 7*n)
+			case "M":
+				t = t.AddDate(0, n, 0)
+			case "y":
+				t = t.AddDate(n, 0, 0)
+			}
+		}
+		return t, nil
+	}
+
+	return time.Time{}, errors.New(dateHelp)
+}
+
+// Reads the timezone from the tz param (an IANA name like America/New_York), UTC if not given
+func parseTimezone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New("Invalid timezone: " + tz)
+	}
+	return loc, nil
+}
+
+// Returns the from and to params converted from the tz param's timezone to UTC for the database.
+// An error (which should be returned to the client as a 400) means the dates or timezone couldn't be read.
+func buildDateRange(queryParams url.Values) (dateRange, error) {
+	tz := ""
+	if len(queryParams["tz"]) > 0 {
+		tz = queryParams["tz"][0]
+	}
+	from := ""
+	if len(queryParams["from"]) > 0 {
+		from = queryParams["from"][0]
+	}
+	to := ""
+	if len(queryParams["to"]) > 0 {
+		to = queryParams["to"][0]
+	}
+	return newDateRange(from, to, tz)
+}
+
+func newDateRange(from string, to string, tz string) (dateRange, error) {
+	return resolveDateRange(from, to, tz, time.Now())
+}
+
+func resolveDateRange(from string, to string, tz string, now time.Time) (dateRange, error) {
+	loc, err := parseTimezone(tz)
+	if err != nil {
+		return dateRange{}, err
+	}
+	dr := dateRange{Location: loc}
+
+	if from != "" {
+		dr.from, err = parseDate(from, loc, now, false)
+		if err != nil {
+			return dr, errors.New("Invalid from date \"" + from + "\": " + err.Error())
+		}
+		dr.From = dr.from.UTC().Format(dbTimeFormat)
+
+		// A period on its own covers the whole period
+		if _, finish, ok := datePeriod(strings.TrimSpace(from), now.In(loc)); ok && to == "" {
+			dr.to = finish
+			dr.To = dr.to.UTC().Format(dbTimeFormat)
+		}
+	}
+	if to != "" {
+		dr.to, err = parseDate(to, loc, now, true)
+		if err != nil {
+			return dr, errors.New("Invalid to date \"" + to + "\": " + err.Error())
+		}
+		dr.To = dr.to.UTC().Format(dbTimeFormat)
+	}
+
+	if !dr.from.IsZero() && !dr.to.IsZero() && dr.from.After(dr.to) {
+		return dr, errors.New("Invalid date range: from (" + dr.from.Format(time.RFC3339) + ") is after to (" + dr.to.Format(time.RFC3339) + ")")
+	}
+	return dr, nil
+}
+
+// The IANA name of the timezone
+func (dr dateRange) Timezone() string {
+	if dr.Location == nil {
+		return "UTC"
+	}
+	return dr.Location.String()
+}
+
+// Sets the params' range and timezone
+func (dr dateRange) apply(params *CommonQueryParams) {
+	params.From = dr.From
+	params.To = dr.To
+	params.Timezone = dr.Timezone()
+}
+
+// Echoes the resolved range (in the requested timezone) and the timezone back in the response
+func (dr dateRange) setMeta(res *config.HypermediaResource) {
+	res.Meta.From = ""
+	if !dr.from.IsZero() {
+		res.Meta.From = dr.from.Format(time.RFC3339)
+	}
+	res.Meta.To = ""
+	if !dr.to.IsZero() {
+		res.Meta.To = dr.to.Format(time.RFC3339)
+	}
+	res.Data["timezone"] = dr.Timezone()
+}
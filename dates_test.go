@@ -0,0 +1,121 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Wednesday
+var testNow = time.Date(2014, 10, 15, 12, 30, 0, 0, time.UTC)
+
+func TestParseDate(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	tests := []struct {
+		value string
+		loc   *time.Location
+		end   bool
+		want  time.Time
+	}{
+		{"2014-10-01", time.UTC, false, time.Date(2014, 10, 1, 0, 0, 0, 0, time.UTC)},
+		{"2014-10-01 12:00", time.UTC, false, time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2014-10-01T12:00:05", time.UTC, false, time.Date(2014, 10, 1, 12, 0, 5, 0, time.UTC)},
+		{"2014-10-01 12:00", newYork, false, time.Date(2014, 10, 1, 16, 0, 0, 0, time.UTC)},
+		{"2014-10-01T12:00:00Z", newYork, false, time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{"2014-10-01T12:00:00+02:00", time.UTC, false, time.Date(2014, 10, 1, 10, 0, 0, 0, time.UTC)},
+		// An unencoded + comes through as a space
+		{"2014-10-01T12:00:00 02:00", time.UTC, false, time.Date(2014, 10, 1, 10, 0, 0, 0, time.UTC)},
+		{"now", time.UTC, false, testNow},
+		{"now-7d", time.UTC, false, testNow.AddDate(0, 0, -7)},
+		{"now-1h30m", time.UTC, false, testNow.Add(-90 * time.Minute)},
+		{"now-1h-30m", time.UTC, false, testNow.Add(-90 * time.Minute)},
+		{"now-1d+2h", time.UTC, false, testNow.AddDate(0, 0, -1).Add(2 * time.Hour)},
+		{"now 1h", time.UTC, false, testNow.Add(time.Hour)},
+		{"now-1M", time.UTC, false, time.Date(2014, 9, 15, 12, 30, 0, 0, time.UTC)},
+		{"now-1y2M", time.UTC, false, time.Date(2013, 8, 15, 12, 30, 0, 0, time.UTC)},
+		{"now-2w", time.UTC, false, testNow.AddDate(0, 0, -14)},
+		{"today", time.UTC, false, time.Date(2014, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"today", time.UTC, true, time.Date(2014, 10, 16, 0, 0, 0, 0, time.UTC)},
+		{"today", newYork, false, time.Date(2014, 10, 15, 4, 0, 0, 0, time.UTC)},
+		{"yesterday", time.UTC, false, time.Date(2014, 10, 14, 0, 0, 0, 0, time.UTC)},
+		{"this-week", time.UTC, false, time.Date(2014, 10, 13, 0, 0, 0, 0, time.UTC)},
+		{"last-week", time.UTC, true, time.Date(2014, 10, 13, 0, 0, 0, 0, time.UTC)},
+		{"last-month", time.UTC, false, time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{"this-year", time.UTC, true, time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.value, tt.loc, testNow, tt.end)
+		if err != nil {
+			t.Errorf("parseDate(%q): %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseDate(%q, %s, end=%v) = %s, want %s", tt.value, tt.loc, tt.end, got.UTC(), tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "yesterdayish", "2014-13-01", "now1h", "now-", "now-1x", "now-999999d", "-1h30m"} {
+		if got, err := parseDate(value, time.UTC, testNow, false); err == nil {
+			t.Errorf("parseDate(%q) = %s, want an error", value, got)
+		}
+	}
+}
+
+func TestResolveDateRange(t *testing.T) {
+	tests := []struct {
+		from, to, tz string
+		wantFrom     string
+		wantTo       string
+	}{
+		{"", "", "", "", ""},
+		{"2014-10-01", "", "", "2014-10-01 00:00:00", ""},
+		{"", "2014-10-01", "", "", "2014-10-01 00:00:00"},
+		{"2014-10-01", "2014-10-02", "America/New_York", "2014-10-01 04:00:00", "2014-10-02 04:00:00"},
+		// A period on its own covers all of it
+		{"last-month", "", "", "2014-09-01 00:00:00", "2014-10-01 00:00:00"},
+		{"last-month", "now", "", "2014-09-01 00:00:00", "2014-10-15 12:30:00"},
+		{"now-1h30m", "now", "", "2014-10-15 11:00:00", "2014-10-15 12:30:00"},
+		{"yesterday", "today", "", "2014-10-14 00:00:00", "2014-10-16 00:00:00"},
+	}
+	for _, tt := range tests {
+		dr, err := resolveDateRange(tt.from, tt.to, tt.tz, testNow)
+		if err != nil {
+			t.Errorf("resolveDateRange(%q, %q, %q): %v", tt.from, tt.to, tt.tz, err)
+			continue
+		}
+		if dr.From != tt.wantFrom || dr.To != tt.wantTo {
+			t.Errorf("resolveDateRange(%q, %q, %q) = %q to %q, want %q to %q", tt.from, tt.to, tt.tz, dr.From, dr.To, tt.wantFrom, tt.wantTo)
+		}
+	}
+
+	bad := []struct{ from, to, tz string }{
+		{"2014-10-02", "2014-10-01", ""},
+		{"now", "now-1d", ""},
+		{"bogus", "", ""},
+		{"", "bogus", ""},
+		{"2014-10-01", "", "Mars/Olympus_Mons"},
+	}
+	for _, tt := range bad {
+		if _, err := resolveDateRange(tt.from, tt.to, tt.tz, testNow); err == nil {
+			t.Errorf("resolveDateRange(%q, %q, %q) should be an error", tt.from, tt.to, tt.tz)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the downsampling of long timeseries (max_points) so they can be drawn. Both ways of doing it keep
+// spikes: LTTB (Largest-Triangle-Three-Buckets) picks the point in each bucket that makes the largest triangle with its
+// neighbours, while minmax keeps the lowest and highest point in each bucket.
+//
+// Periods are treated as evenly spaced and each series is downsampled on its own. Null points are dropped.
+package main
+
+import (
+	"math"
+)
+
+const (
+	downsampleLTTB   = "lttb"
+	downsampleMinMax = "minmax"
+)
+
+// The fewest points that can be asked for (LTTB always keeps the first and last)
+const minDownsamplePoints = 3
+
+type downsamplePoint struct {
+	// The position in the timeseries
+	index int
+	y     float64
+}
+
+// What's drawn for a period: the transformed value if there's a transform, otherwise the count
+func timeseriesPointValue(count ResultTimeseriesCount) (float64, bool) {
+	if count.Transform != "" {
+		if count.Value == nil {
+			return 0, false
+		}
+		return *count.Value, true
+	}
+	if count.Count == nil {
+		return 0, false
+	}
+	return float64(*count.Count), true
+}
+
+// Returns the indexes of the points LTTB keeps
+func lttb(points []downsamplePoint, threshold int) []int {
+	if threshold >= len(points) || threshold < minDownsamplePoints {
+		kept := make([]int, len(points))
+		for i, p := range points {
+			kept[i] = p.index
+		}
+		return kept
+	}
+
+	kept := []int{points[0].index}
+	// The first and last points are always kept, everything between is split into threshold-2 buckets. The bucket
+	// boundaries are worked out in integers, floating point can leave a point out of every bucket.
+	buckets := threshold - 2
+	bucketStart := func(i int) int {
+		return i*(len(points)-2)/buckets + 1
+	}
+	a := 0
+	for i := 0; i < buckets; i++ {
+		// The average of the next bucket (just the last point after the last bucket) is the third point of the triangle
+		nextStart := bucketStart(i + 1)
+		nextEnd := bucketStart(i + 2)
+		if nextEnd > len(points) || i == buckets-1 {
+			nextEnd = len(points)
+		}
+		avgX, avgY := 0.0, 0.0
+		for j := nextStart; j < nextEnd; j++ {
+			avgX += float64(points[j].index)
+			avgY += points[j].y
+		}
+		if n := float64(nextEnd - nextStart); n > 0 {
+			avgX /= n
+			avgY /= n
+		}
+
+		start := bucketStart(i)
+		end := bucketStart(i + 1)
+		ax, ay := float64(points[a].index), points[a].y
+		maxArea := -1.0
+		next := start
+		for j := start; j < end; j++ {
+			area := math.Abs((ax-avgX)*(points[j].y-ay) - (ax-float64(points[j].index))*(avgY-ay))
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+		kept = append(kept, points[next].index)
+		a = next
+	}
+	return append(kept, points[len(points)-1].index)
+}
+
+// Returns the indexes of the lowest and highest points in each bucket (in order), about threshold of them in all
+func minMax(points []downsamplePoint, threshold int) []int {
+	if threshold >= len(points) || threshold < minDownsamplePoints {
+		return lttb(points, len(points))
+	}
+
+	kept := []int{}
+	buckets := threshold / 2
+	for i := 0; i < buckets; i++ {
+		start := i * len(points) / buckets
+		end := (i + 1) * len(points) / buckets
+		if start >= end {
+			continue
+		}
+		low, high := start, start
+		for j := start; j < end; j++ {
+			if points[j].y < points[low].y {
+				low = j
+			}
+			if points[j].y > points[high].y {
+				high = j
+			}
+		}
+		if low > high {
+			low, high = high, low
+		}
+		kept = append(kept, points[low].index)
+		if high != low {
+			kept = append(kept, points[high].index)
+		}
+	}
+	return kept
+}
+
+// Reduces each series in the timeseries to about maxPoints points, leaving the rest in order
+func downsampleTimeseries(counts []ResultTimeseriesCount, maxPoints int, method string) []ResultTimeseriesCount {
+	if maxPoints <= 0 {
+		return counts
+	}
+
+	series := map[string][]downsamplePoint{}
+	order := []string{}
+	for i, count := range counts {
+		y, ok := timeseriesPointValue(count)
+		if !ok {
+			continue
+		}
+		if _, seen := series[count.Series]; !seen {
+			order = append(order, count.Series)
+		}
+		series[count.Series] = append(series[count.Series], downsamplePoint{index: i, y: y})
+	}
+
+	kept := map[int]bool{}
+	for _, name := range order {
+		var indexes []int
+		if method == downsampleMinMax {
+			indexes = minMax(series[name], maxPoints)
+		} else {
+			indexes = lttb(series[name], maxPoints)
+		}
+		for _, i := range indexes {
+			kept[i] = true
+		}
+	}
+
+	downsampled := []ResultTimeseriesCount{}
+	for i, count := range counts {
+		if kept[i] {
+			downsampled = append(downsampled, count)
+		}
+	}
+	return downsampled
+}
@@ -0,0 +1,136 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func flatPoints(n int) []downsamplePoint {
+	points := make([]downsamplePoint, n)
+	for i := range points {
+		points[i] = downsamplePoint{index: i, y: 10}
+	}
+	return points
+}
+
+// The indexes must be in order, without repeats, and within the points
+func checkIndexes(t *testing.T, name string, indexes []int, n int) {
+	for i, index := range indexes {
+		if index < 0 || index >= n {
+			t.Errorf("%s: index %d out of range", name, index)
+		}
+		if i > 0 && index <= indexes[i-1] {
+			t.Errorf("%s: indexes out of order or repeated: %v", name, indexes)
+			return
+		}
+	}
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLttb(t *testing.T) {
+	// Nothing to do when there are already few enough points (or too few are asked for)
+	for _, threshold := range []int{0, 2, 5, 10} {
+		if kept := lttb(flatPoints(5), threshold); len(kept) != 5 {
+			t.Errorf("lttb(5 points, %d) kept %d, want all 5", threshold, len(kept))
+		}
+	}
+
+	for n := 4; n <= 60; n++ {
+		for threshold := minDownsamplePoints; threshold < n; threshold++ {
+			kept := lttb(flatPoints(n), threshold)
+			if len(kept) != threshold {
+				t.Fatalf("lttb(%d points, %d) kept %d", n, threshold, len(kept))
+			}
+			checkIndexes(t, "lttb", kept, n)
+			if kept[0] != 0 || kept[len(kept)-1] != n-1 {
+				t.Errorf("lttb(%d points, %d) didn't keep the first and last: %v", n, threshold, kept)
+			}
+			// A spike anywhere is kept (which also means every point is in a bucket)
+			for spike := 0; spike < n; spike++ {
+				points := flatPoints(n)
+				points[spike].y = 1000
+				if kept := lttb(points, threshold); !containsIndex(kept, spike) {
+					t.Fatalf("lttb(%d points, %d) lost the spike at %d: %v", n, threshold, spike, kept)
+				}
+			}
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	if kept := minMax(flatPoints(5), 10); len(kept) != 5 {
+		t.Errorf("minMax(5 points, 10) kept %d, want all 5", len(kept))
+	}
+
+	for n := 4; n <= 60; n++ {
+		for threshold := minDownsamplePoints; threshold < n; threshold++ {
+			kept := minMax(flatPoints(n), threshold)
+			if len(kept) > threshold || len(kept) == 0 {
+				t.Fatalf("minMax(%d points, %d) kept %d", n, threshold, len(kept))
+			}
+			checkIndexes(t, "minMax", kept, n)
+			// A spike and a dip anywhere are both kept
+			for spike := 0; spike < n; spike++ {
+				dip := (spike + n/2) % n
+				points := flatPoints(n)
+				points[spike].y = 1000
+				points[dip].y = -1000
+				kept := minMax(points, threshold)
+				if !containsIndex(kept, spike) || !containsIndex(kept, dip) {
+					t.Fatalf("minMax(%d points, %d) lost the spike at %d or dip at %d: %v", n, threshold, spike, dip, kept)
+				}
+				checkIndexes(t, "minMax", kept, n)
+			}
+		}
+	}
+}
+
+func TestDownsampleTimeseries(t *testing.T) {
+	counts := []ResultTimeseriesCount{}
+	for i := 0; i < 100; i++ {
+		for _, series := range []string{"a", "b"} {
+			c := i
+			counts = append(counts, ResultTimeseriesCount{Count: &c, Series: series})
+		}
+	}
+	// A null point is dropped
+	counts[10].Count = nil
+
+	downsampled := downsampleTimeseries(counts, 10, downsampleLTTB)
+	perSeries := map[string]int{}
+	for _, count := range downsampled {
+		if count.Count == nil {
+			t.Fatal("a null point was kept")
+		}
+		perSeries[count.Series]++
+	}
+	if perSeries["a"] != 10 || perSeries["b"] != 10 {
+		t.Errorf("got %v points per series, want 10 each", perSeries)
+	}
+	if len(downsampleTimeseries(counts, 0, downsampleLTTB)) != len(counts) {
+		t.Error("max_points of 0 should leave the timeseries alone")
+	}
+}
@@ -0,0 +1,576 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the content negotiation and writers for exporting API responses as CSV, TSV and Excel (xlsx)
+// along with the bulk (streaming) export of messages.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats and their content types
+var exportContentTypes = map[string]string{
+	"json": "application/json",
+	"csv":  "text/csv; charset=utf-8",
+	"tsv":  "text/tab-separated-values; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// A flat table of results, the columns for each endpoint are always the same (and in the same order) regardless of the data returned.
+type exportTable struct {
+	Columns []string
+	Rows    [][]string
+	// Columns that hold numbers (xlsx writes these as numbers, everything else is text so ids keep every digit)
+	Numeric map[string]bool
+}
+
+func numericColumns(columns ...string) map[string]bool {
+	numeric := map[string]bool{}
+	for _, c := range columns {
+		numeric[c] = true
+	}
+	return numeric
+}
+
+// Returns the requested response format. The "format" querystring parameter wins over the Accept header. JSON is the default.
+// An empty string is returned when a format was asked for that we don't support.
+func requestedFormat(r *rest.Request) string {
+	queryParams := r.URL.Query()
+	if len(queryParams["format"]) > 0 && queryParams["format"][0] != "" {
+		format := strings.ToLower(queryParams["format"][0])
+		if _, ok := exportContentTypes[format]; ok {
+			return format
+		}
+		return ""
+	}
+
+	return acceptedFormat(r.Header.Get("Accept"))
+}
+
+// Picks the format from an Accept header. The type with the highest q-value wins and a type that is named explicitly wins over a
+// wildcard with the same q-value (so "text/csv, */*;q=0.1" is CSV). JSON is returned when nothing we support is acceptable.
+func acceptedFormat(accept string) string {
+	format := "json"
+	bestQ := -1.0
+	bestExplicit := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parts := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		f, explicit := "", true
+		switch mediaType {
+		case "application/json":
+			f = "json"
+		case "text/csv":
+			f = "csv"
+		case "text/tab-separated-values":
+			f = "tsv"
+		case exportContentTypes["xlsx"]:
+			f = "xlsx"
+		case "*/*", "application/*":
+			f, explicit = "json", false
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && explicit && !bestExplicit) {
+			format, bestQ, bestExplicit = f, q, explicit
+		}
+	}
+	return format
+}
+
+// Writes the resource in the requested format. JSON is the resource as usual, anything else is the table built by the given func.
+// Endpoints that can't be represented as a table pass nil and respond with a 406 if another format is asked for.
+func writeResource(w rest.ResponseWriter, r *rest.Request, res *config.HypermediaResource, name string, table func() exportTable) {
+	format := requestedFormat(r)
+	if format == "json" {
+		// The rows are only counted (as they would be exported) when they're being audited
+		if table != nil && auditing() {
+			setAuditRows(r, len(table().Rows))
+		}
+		w.WriteJson(res.End())
+		return
+	}
+	if format == "" || table == nil {
+		rest.Error(w, "Not Acceptable: this endpoint can be returned as json, csv, tsv or xlsx (not all endpoints support every format)", http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+exportFilename(r, name, format)+`"`)
+	rows := table()
+	setAuditRows(r, len(rows.Rows))
+	err := writeTable(w.(http.ResponseWriter), format, rows)
+	if err != nil {
+		// Headers are already gone, so all that can be done is log it
+		log.Println(err)
+	}
+}
+
+// Writes a table out as csv, tsv or xlsx
+func writeTable(out io.Writer, format string, table exportTable) error {
+	switch format {
+	case "csv", "tsv":
+		cw := csv.NewWriter(out)
+		if format == "tsv" {
+			cw.Comma = '\t'
+		}
+		cw.Write(table.Columns)
+		for _, row := range table.Rows {
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	case "xlsx":
+		return writeXlsx(out, table)
+	}
+	return fmt.Errorf("unsupported export format: %s", format)
+}
+
+// Filenames look like: territory-name-top-hashtags-2014-10-01-2014-11-01-UTC.csv
+// Relative dates (now-7d, last-month, etc.) are resolved first, so the name says which dates are actually in the file.
+func exportFilename(r *rest.Request, name string, format string) string {
+	// The handlers have already turned away a range that doesn't parse
+	dr, _ := buildDateRange(r.URL.Query())
+	return dateRangeFilename(r.PathParam("territory"), name, format, dr)
+}
+
+func dateRangeFilename(territory string, name string, format string, dr dateRange) string {
+	parts := []string{}
+	if territory != "" {
+		parts = append(parts, territory)
+	}
+	parts = append(parts, name)
+
+	if dr.from.IsZero() && dr.to.IsZero() {
+		parts = append(parts, "all-time")
+	} else {
+		from := "start"
+		if !dr.from.IsZero() {
+			from = filenameTime(dr.from)
+		}
+		to := "now"
+		if !dr.to.IsZero() {
+			to = filenameTime(dr.to)
+		}
+		parts = append(parts, from, to)
+	}
+	parts = append(parts, dr.Timezone())
+
+	r2, _ := regexp.Compile(`[^A-Za-z0-9\-\.]+`)
+	return r2.ReplaceAllString(strings.Join(parts, "_"), "-") + "." + format
+}
+
+// Just the date when it's midnight, the time as well when it isn't
+func filenameTime(t time.Time) string {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format("2006-01-02")
+	}
+	return t.Format("2006-01-02T150405")
+}
+
+// --------- Table builders for the various endpoints ---------
+
+// Aggregates (and all of the top lists) are one row per value per field
+func aggregateTable(aggregate interface{}) exportTable {
+	table := exportTable{Columns: []string{"field", "value", "count", "total", "distinct", "timeFrom", "timeTo"}, Rows: [][]string{}, Numeric: numericColumns("count", "total", "distinct")}
+	fieldCounts, _ := aggregate.([]ResultAggregateFields)
+	for _, fc := range fieldCounts {
+		for field, counts := range fc.Count {
+			for _, c := range counts {
+				table.Rows = append(table.Rows, []string{field, c.Value, strconv.Itoa(c.Count), strconv.Itoa(fc.Total), strconv.Itoa(fc.Distinct), fc.TimeFrom, fc.TimeTo})
+			}
+		}
+	}
+	return table
+}
+
+// Counts are one row per count
+func countTable(counts []ResultCount) exportTable {
+	table := exportTable{Columns: []string{"timeFrom", "timeTo", "count"}, Rows: [][]string{}, Numeric: numericColumns("count")}
+	for _, c := range counts {
+		table.Rows = append(table.Rows, []string{c.TimeFrom, c.TimeTo, strconv.Itoa(c.Count)})
+	}
+	return table
+}
+
+// Timeseries counts are one row per period, null counts and values are left blank
+func timeseriesTable(counts []ResultTimeseriesCount) exportTable {
+	table := exportTable{Columns: []string{"series", "timeFrom", "timeTo", "count", "partial", "timezone", "transform", "value"}, Rows: [][]string{}, Numeric: numericColumns("count", "value")}
+	for _, c := range counts {
+		count := ""
+		if c.Count != nil {
+			count = strconv.Itoa(*c.Count)
+		}
+		value := ""
+		if c.Value != nil {
+			value = strconv.FormatFloat(*c.Value, 'f', -1, 64)
+		}
+		table.Rows = append(table.Rows, []string{c.Series, c.TimeFrom, c.TimeTo, count, strconv.FormatBool(c.Partial), c.Timezone, c.Transform, value})
+	}
+	return table
+}
+
+// The heatmap is one row per day of week and hour of day
+func heatmapTable(heatmap ResultHeatmap) exportTable {
+	table := exportTable{Columns: []string{"dayOfWeek", "hour", "count", "engagement", "timezone"}, Rows: [][]string{}, Numeric: numericColumns("hour", "count", "engagement")}
+	for d, hours := range heatmap.Counts {
+		for h, count := range hours {
+			engagement := ""
+			if heatmap.Engagement != nil {
+				engagement = strconv.Itoa(heatmap.Engagement[d][h])
+			}
+			table.Rows = append(table.Rows, []string{time.Weekday(d).String(), strconv.Itoa(h), strconv.Itoa(count), engagement, heatmap.Timezone})
+		}
+	}
+	return table
+}
+
+// Overlap is one row per Venn region per network (and "all" for the overall figures)
+func overlapTable(overlap ResultAudienceOverlap) exportTable {
+	table := exportTable{Columns: []string{"network", "territories", "count"}, Rows: [][]string{}, Numeric: numericColumns("count")}
+	for _, region := range overlap.Regions {
+		table.Rows = append(table.Rows, []string{"all", strings.Join(region.Territories, ","), strconv.Itoa(region.Count)})
+	}
+	networks := []string{}
+	for network := range overlap.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		for _, region := range overlap.Networks[network].Regions {
+			table.Rows = append(table.Rows, []string{network, strings.Join(region.Territories, ","), strconv.Itoa(region.Count)})
+		}
+	}
+	return table
+}
+
+// Cohorts are one row per cohort per period since it started
+func cohortsTable(cohorts ResultCohorts) exportTable {
+	table := exportTable{Columns: []string{"cohort", "size", "periodsSince", "active", "retention"}, Rows: [][]string{}, Numeric: numericColumns("size", "periodsSince", "active", "retention")}
+	for _, c := range cohorts.Cohorts {
+		for i := range c.Active {
+			table.Rows = append(table.Rows, []string{c.Period, strconv.Itoa(c.Size), strconv.Itoa(i), strconv.Itoa(c.Active[i]), strconv.FormatFloat(c.Retention[i], 'f', 2, 64)})
+		}
+	}
+	return table
+}
+
+// Builds a table from a slice of structs (messages, contributors, etc.) using the JSON field names as columns, in struct order.
+// Int and float fields are numeric columns, strings stay text even when they look like numbers (message and contributor ids).
+func structsTable(slice interface{}) exportTable {
+	table := exportTable{Columns: []string{}, Rows: [][]string{}, Numeric: map[string]bool{}}
+	v := reflect.ValueOf(slice)
+	if v.Kind() != reflect.Slice {
+		return table
+	}
+	t := v.Type().Elem()
+	if t.Kind() != reflect.Struct {
+		return table
+	}
+
+	fields := []int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, i)
+		table.Columns = append(table.Columns, name)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+			table.Numeric[name] = true
+		}
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		row := make([]string, len(fields))
+		for j, fi := range fields {
+			row[j] = exportValue(v.Index(i).Field(fi).Interface())
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+// Formats a single value for a table cell
+func exportValue(value interface{}) string {
+	switch val := value.(type) {
+	case string:
+		return val
+	case time.Time:
+		return val.UTC().Format(time.RFC3339)
+	case float32, float64:
+		return strconv.FormatFloat(reflect.ValueOf(val).Float(), 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// --------- XLSX ---------
+// An xlsx file is just a zip of some XML files. Only a single sheet of inline strings and numbers is needed here,
+// so it's written out by hand rather than pulling in a whole spreadsheet package.
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Social Harvest" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+
+// Writes the table as a single sheet xlsx workbook
+func writeXlsx(out io.Writer, table exportTable) error {
+	// The zip needs to be complete before anything is sent (it's small enough, these are reports not bulk exports)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct {
+		Name string
+		Body string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, file.Body); err != nil {
+			return err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	var sb bytes.Buffer
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	sb.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	numeric := make([]bool, len(table.Columns))
+	for i, c := range table.Columns {
+		numeric[i] = table.Numeric[c]
+	}
+	writeXlsxRow(&sb, 1, table.Columns, nil)
+	for i, row := range table.Rows {
+		writeXlsxRow(&sb, i+2, row, numeric)
+	}
+	sb.WriteString(`</sheetData></worksheet>`)
+	if _, err = sheet.Write(sb.Bytes()); err != nil {
+		return err
+	}
+
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(out)
+	return err
+}
+
+// Writes a row of cells, those in numeric columns are stored as numbers so they can be summed, etc. (blank ones are left as text)
+func writeXlsxRow(sb *bytes.Buffer, rowNum int, cells []string, numeric []bool) {
+	sb.WriteString(`<row r="`)
+	sb.WriteString(strconv.Itoa(rowNum))
+	sb.WriteString(`">`)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(rowNum)
+		if _, err := strconv.ParseFloat(cell, 64); err == nil && i < len(numeric) && numeric[i] && !strings.ContainsAny(cell, "eEnNxXpP") {
+			sb.WriteString(`<c r="` + ref + `"><v>` + cell + `</v></c>`)
+			continue
+		}
+		sb.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(sb, []byte(cell))
+		sb.WriteString(`</t></is></c>`)
+	}
+	sb.WriteString(`</row>`)
+}
+
+// Column letters: 0 is A, 25 is Z, 26 is AA, etc.
+func xlsxColumn(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
+
+// --------- Bulk export ---------
+
+// Content types for the bulk message export formats
+var bulkExportContentTypes = map[string]string{
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// Streams every message for a territory (with the same filters as messages) as NDJSON, optionally gzipped, or Parquet.
+// Messages are read in batches and written out as they come so the export can be as large as needed.
+func writeMessagesExport(out io.Writer, format string, params CommonQueryParams, conds BasicConditions) (int, error) {
+	written := 0
+	switch format {
+	case "parquet":
+		pw := parquet.NewGenericWriter[config.SocialHarvestMessage](out)
+		err := db.EachMessages(params, conds, func(batch []config.SocialHarvestMessage) error {
+			if _, err := pw.Write(batch); err != nil {
+				return err
+			}
+			written += len(batch)
+			// Each batch becomes its own row group so nothing more than a batch is buffered
+			return pw.Flush()
+		})
+		if err != nil {
+			return written, err
+		}
+		return written, pw.Close()
+	case "ndjson":
+		enc := json.NewEncoder(out)
+		err := db.EachMessages(params, conds, func(batch []config.SocialHarvestMessage) error {
+			for _, msg := range batch {
+				if err := enc.Encode(msg); err != nil {
+					return err
+				}
+				written++
+			}
+			if f, ok := out.(http.Flusher); ok {
+				f.Flush()
+			}
+			return nil
+		})
+		return written, err
+	}
+	return written, fmt.Errorf("unsupported export format: %s", format)
+}
+
+// API: Streams all of the messages for a territory as NDJSON (?format=ndjson, the default, with optional &gzip=true) or Parquet (?format=parquet).
+func TerritoryMessagesExport(w rest.ResponseWriter, r *rest.Request) {
+	territory := r.PathParam("territory")
+	queryParams := r.URL.Query()
+
+	format := "ndjson"
+	if len(queryParams["format"]) > 0 && queryParams["format"][0] != "" {
+		format = strings.ToLower(queryParams["format"][0])
+	}
+	contentType, ok := bulkExportContentTypes[format]
+	if !ok {
+		rest.Error(w, "Not Acceptable: messages can be exported as ndjson or parquet", http.StatusNotAcceptable)
+		return
+	}
+	compress := false
+	if len(queryParams["gzip"]) > 0 && format == "ndjson" {
+		compress, _ = strconv.ParseBool(queryParams["gzip"][0])
+	}
+	if territory == "" {
+		rest.Error(w, "A territory is required", http.StatusBadRequest)
+		return
+	}
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: territory,
+		Network:   network,
+	}
+	dr.apply(&params)
+
+	filename := exportFilename(r, "messages", format)
+	var out io.Writer = w.(http.ResponseWriter)
+	if compress {
+		filename += ".gz"
+		contentType = "application/gzip"
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = &flushingGzipWriter{gz: gz, w: w.(http.ResponseWriter)}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	written, err := writeMessagesExport(out, format, params, buildBasicConditions(queryParams))
+	setAuditRows(r, written)
+	if err != nil {
+		// The response has already started, so all that can be done is log it (the file will be incomplete)
+		log.Println(err)
+	}
+}
+
+// Flushes the gzip stream through to the client after each batch of messages
+type flushingGzipWriter struct {
+	gz *gzip.Writer
+	w  http.ResponseWriter
+}
+
+func (f *flushingGzipWriter) Write(p []byte) (int, error) {
+	return f.gz.Write(p)
+}
+
+func (f *flushingGzipWriter) Flush() {
+	f.gz.Flush()
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
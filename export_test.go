@@ -0,0 +1,102 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAcceptedFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "json"},
+		{"*/*", "json"},
+		{"application/json", "json"},
+		{"text/csv", "csv"},
+		{"text/csv, */*;q=0.1", "csv"},
+		{"*/*, text/csv", "csv"},
+		{"application/json;q=0.5, text/tab-separated-values", "tsv"},
+		{"text/csv;q=0.2, application/json;q=0.8", "json"},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"},
+		{"text/csv;q=0, */*", "json"},
+		{"text/html, image/png", "json"},
+		{"TEXT/CSV ; q=0.9", "csv"},
+	}
+	for _, tt := range tests {
+		if got := acceptedFormat(tt.accept); got != tt.want {
+			t.Errorf("acceptedFormat(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestXlsxNumericColumns(t *testing.T) {
+	type row struct {
+		MessageId string  `json:"message_id"`
+		Followers int     `json:"contributor_followers"`
+		Score     float64 `json:"score"`
+	}
+	table := structsTable([]row{{MessageId: "524000000000000001", Followers: 12, Score: 0.5}, {MessageId: "007"}})
+	if !table.Numeric["contributor_followers"] || !table.Numeric["score"] || table.Numeric["message_id"] {
+		t.Fatalf("got numeric columns %v", table.Numeric)
+	}
+
+	numeric := []bool{false, true, true}
+	var sb bytes.Buffer
+	writeXlsxRow(&sb, 2, table.Rows[0], numeric)
+	want := `<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">524000000000000001</t></is></c><c r="B2"><v>12</v></c><c r="C2"><v>0.5</v></c></row>`
+	if sb.String() != want {
+		t.Errorf("got %s\nwant %s", sb.String(), want)
+	}
+	sb.Reset()
+	writeXlsxRow(&sb, 3, []string{"007", "", "x"}, numeric)
+	want = `<row r="3"><c r="A3" t="inlineStr"><is><t xml:space="preserve">007</t></is></c><c r="B3" t="inlineStr"><is><t xml:space="preserve"></t></is></c><c r="C3" t="inlineStr"><is><t xml:space="preserve">x</t></is></c></row>`
+	if sb.String() != want {
+		t.Errorf("got %s\nwant %s", sb.String(), want)
+	}
+	// The header row is never numeric
+	sb.Reset()
+	writeXlsxRow(&sb, 1, []string{"1"}, nil)
+	if want = `<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">1</t></is></c></row>`; sb.String() != want {
+		t.Errorf("got %s\nwant %s", sb.String(), want)
+	}
+}
+
+func TestDateRangeFilename(t *testing.T) {
+	tests := []struct {
+		from, to, tz string
+		want         string
+	}{
+		{"", "", "", "acme-count-all-time-UTC.csv"},
+		{"2014-10-01", "2014-11-01", "", "acme-count-2014-10-01-2014-11-01-UTC.csv"},
+		{"last-month", "now", "", "acme-count-2014-09-01-2014-10-15T123000-UTC.csv"},
+		{"now-7d", "", "", "acme-count-2014-10-08T123000-now-UTC.csv"},
+		{"", "yesterday", "", "acme-count-start-2014-10-15-UTC.csv"},
+		{"today", "", "America/New_York", "acme-count-2014-10-15-2014-10-16-America-New-York.csv"},
+	}
+	for _, tt := range tests {
+		dr, err := resolveDateRange(tt.from, tt.to, tt.tz, testNow)
+		if err != nil {
+			t.Skip(err)
+		}
+		if got := dateRangeFilename("acme", "count", "csv", dr); got != tt.want {
+			t.Errorf("from %q to %q (%s): got %s, want %s", tt.from, tt.to, tt.tz, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains JWT authentication, so tokens from an identity provider (OIDC, etc.) can be used instead of API keys.
+// Tokens are signed with RS256 or ES256 and checked against the keys in a JWKS (a file or a URL, see JwtConf). The issuer,
+// audience and expiry are checked and claims say which territories and groups of routes (see auth.go) the token allows.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most a JWKS document can be
+const maxJwksSize = 1 << 20
+
+// When a token is signed with a key that isn't in the JWKS, it's fetched again (but not more often than this)
+const jwksMissRefresh = time.Minute
+
+// A JSON Web Key (RFC 7517), only what's needed for RSA and P-256 keys
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// A key from the JWKS that tokens can be checked against
+type jwtKey struct {
+	kid string
+	// RS256 or ES256
+	alg string
+	key crypto.PublicKey
+}
+
+// Checks tokens against the configured JWKS, issuer and audience
+type jwtVerifier struct {
+	conf    JwtConf
+	refresh time.Duration
+	leeway  time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      []jwtKey
+	fetched   time.Time
+	lastFetch time.Time
+}
+
+// The verifier for the configured JWKS, nil when JWT auth isn't configured
+var jwtAuth *jwtVerifier
+
+func newJwtVerifier(conf JwtConf) (*jwtVerifier, error) {
+	if conf.Jwks == "" {
+		return nil, errors.New("JWT auth needs a jwks file or URL")
+	}
+	if conf.Issuer == "" || len(conf.Audience) == 0 {
+		return nil, errors.New("JWT auth needs an issuer and an audience")
+	}
+	v := &jwtVerifier{conf: conf, refresh: time.Hour, leeway: time.Minute, client: &http.Client{Timeout: 10 * time.Second}}
+	if conf.Refresh != "" {
+		refresh, err := time.ParseDuration(conf.Refresh)
+		if err != nil || refresh < time.Minute {
+			return nil, errors.New("Invalid JWKS refresh (a Go duration of at least 1m): " + conf.Refresh)
+		}
+		v.refresh = refresh
+	}
+	if conf.Leeway != "" {
+		leeway, err := time.ParseDuration(conf.Leeway)
+		if err != nil || leeway < 0 {
+			return nil, errors.New("Invalid JWT leeway (a Go duration): " + conf.Leeway)
+		}
+		v.leeway = leeway
+	}
+	for _, scope := range conf.DefaultScopes {
+		if !stringInSlice(scope, authScopes) {
+			return nil, errors.New("Unknown JWT default scope: " + scope + " (use " + strings.Join(authScopes, ", ") + ")")
+		}
+	}
+	// The keys are loaded up front so a bad JWKS stops the server from starting
+	keys, err := v.fetch()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	v.lastFetch = v.fetched
+	return v, nil
+}
+
+// Reads the keys from the JWKS file or URL (without touching the keys in use, see keysFor)
+func (v *jwtVerifier) fetch() ([]jwtKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(v.conf.Jwks, "http://") || strings.HasPrefix(v.conf.Jwks, "https://") {
+		var resp *http.Response
+		resp, err = v.client.Get(v.conf.Jwks)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("Couldn't fetch the JWKS: " + resp.Status)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxJwksSize))
+	} else {
+		data, err = ioutil.ReadFile(v.conf.Jwks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	set := jsonWebKeySet{}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, errors.New("Couldn't read the JWKS: " + err.Error())
+	}
+	keys := []jwtKey{}
+	for _, jwk := range set.Keys {
+		// Encryption keys and anything that isn't RSA or P-256 are skipped
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("The JWKS has no RS256 or ES256 signing keys")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (jwtKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		if jwk.Alg != "" && jwk.Alg != "RS256" {
+			break
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, errors.New("Invalid RSA exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return jwtKey{}, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return jwtKey{kid: jwk.Kid, alg: "RS256", key: key}, nil
+	case "EC":
+		if jwk.Crv != "P-256" || (jwk.Alg != "" && jwk.Alg != "ES256") {
+			break
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return jwtKey{}, errors.New("The EC key isn't on the curve")
+		}
+		return jwtKey{kid: jwk.Kid, alg: "ES256", key: key}, nil
+	}
+	return jwtKey{}, errors.New("Unsupported key")
+}
+
+// Returns the keys a token with this kid and alg could be signed with, fetching the JWKS again if it's due (or the kid is new).
+// The fetch happens outside the lock so other requests carry on with the keys already loaded in the meantime, and only
+// the request that started it waits for it.
+func (v *jwtVerifier) keysFor(kid string, alg string) []jwtKey {
+	find := func() []jwtKey {
+		found := []jwtKey{}
+		for _, key := range v.keys {
+			if key.alg == alg && (kid == "" || key.kid == kid) {
+				found = append(found, key)
+			}
+		}
+		return found
+	}
+
+	v.mu.Lock()
+	found := find()
+	stale := time.Since(v.fetched) > v.refresh
+	refetch := (stale || len(found) == 0) && time.Since(v.lastFetch) > jwksMissRefresh
+	if refetch {
+		// Anyone else that comes along now sees a fetch has just been tried and doesn't start another
+		v.lastFetch = time.Now()
+	}
+	v.mu.Unlock()
+	if !refetch {
+		return found
+	}
+
+	// If the JWKS can't be fetched, the keys already loaded keep being used
+	keys, err := v.fetch()
+	if err != nil {
+		log.Println("Couldn't refresh the JWKS: " + err.Error())
+		return found
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.fetched = time.Now()
+	return find()
+}
+
+// The claims that are checked (the territories and scopes claims are configurable, so all of them are kept)
+type jwtClaims map[string]interface{}
+
+func (c jwtClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// A claim that can be a string (space or comma separated) or an array of strings
+func (c jwtClaims) strings(name string) ([]string, bool) {
+	values := []string{}
+	switch v := c[name].(type) {
+	case string:
+		values = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	default:
+		return values, false
+	}
+	return values, true
+}
+
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	n, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+var errInvalidToken = errors.New("Invalid token")
+
+// Whether a credential is a JWT (rather than an API key)
+func looksLikeJwt(s string) bool {
+	return strings.Count(s, ".") == 2 && strings.HasPrefix(s, "eyJ")
+}
+
+// Checks the token's signature and claims, returning who it's for
+func (v *jwtVerifier) verify(token string, now time.Time) (*authPrincipal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err = json.Unmarshal(headerJson, &header); err != nil {
+		return nil, errInvalidToken
+	}
+	// Only the algorithms the keys are for, never "none" or HMAC (which would use a public key as the secret)
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, errors.New("Unsupported token algorithm: " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, key := range v.keysFor(header.Kid, header.Alg) {
+		switch pub := key.key.(type) {
+		case *rsa.PublicKey:
+			verified = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+		case *ecdsa.PublicKey:
+			// JWS ES256 signatures are r and s, 32 bytes each
+			if len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				verified = ecdsa.Verify(pub, digest[:], r, s)
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("The token's signature couldn't be verified")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	claims := jwtClaims{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	return v.principal(claims, now)
+}
+
+// Checks the issuer, audience and times, then maps the claims to territories and scopes
+func (v *jwtVerifier) principal(claims jwtClaims, now time.Time) (*authPrincipal, error) {
+	if claims.str("iss") != v.conf.Issuer {
+		return nil, errors.New("The token is from the wrong issuer")
+	}
+	audience, _ := claims.strings("aud")
+	audienceOk := false
+	for _, aud := range v.conf.Audience {
+		if stringInSlice(aud, audience) {
+			audienceOk = true
+		}
+	}
+	if !audienceOk {
+		return nil, errors.New("The token is for a different audience")
+	}
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, errors.New("The token has no expiry")
+	}
+	if !now.Before(exp.Add(v.leeway)) {
+		return nil, errors.New("The token has expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return nil, errors.New("The token isn't valid yet")
+	}
+
+	p := &authPrincipal{Id: "jwt:" + claims.str("sub"), Expires: exp.Add(v.leeway)}
+
+	// A token has to say which territories it's for ("*" for all of them)
+	territoriesClaim := v.conf.TerritoriesClaim
+	if territoriesClaim == "" {
+		territoriesClaim = "territories"
+	}
+	territories, _ := claims.strings(territoriesClaim)
+	if len(territories) == 0 {
+		return nil, errors.New("The token doesn't allow any territories (" + territoriesClaim + ")")
+	}
+	if !stringInSlice("*", territories) {
+		p.Territories = territories
+	}
+
+	// Scopes that aren't ours (openid, profile, etc.) are ignored, the defaults are used if none are
+	scopesClaim := v.conf.ScopesClaim
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+	}
+	scopes, _ := claims.strings(scopesClaim)
+	for _, scope := range scopes {
+		if stringInSlice(scope, authScopes) {
+			p.Scopes = append(p.Scopes, scope)
+		}
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = v.conf.DefaultScopes
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{scopeRead}
+		}
+	}
+	return p, nil
+}
+
+// --------- API JWT Auth Middleware. It goes before BasicAuthMw, which then lets through anything this has already authenticated.
+// When there are no API keys (Fallback is false) a request without a token is turned away here.
+type JwtAuthMw struct {
+	Realm    string
+	Verifier *jwtVerifier
+	Fallback bool
+}
+
+func (jamw *JwtAuthMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		token, err := requestCredentials(r)
+		if err != nil || !looksLikeJwt(token) {
+			if jamw.Fallback {
+				handler(w, r)
+				return
+			}
+			jamw.unauthorized(w, "")
+			return
+		}
+
+		principal, err := jamw.Verifier.verify(token, time.Now())
+		if err != nil {
+			jamw.unauthorized(w, err.Error())
+			return
+		}
+		r.Env[authEnvKey] = principal
+
+		handler(w, r)
+	}
+}
+
+func (jamw *JwtAuthMw) unauthorized(w rest.ResponseWriter, reason string) {
+	if reason == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+jamw.Realm+`"`)
+		rest.Error(w, "Not Authorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+jamw.Realm+`", error="invalid_token", error_description="`+reason+`"`)
+	rest.Error(w, "Not Authorized: "+reason, http.StatusUnauthorized)
+}
@@ -0,0 +1,283 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jwtTestNow = time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)
+
+type jwtTestKeys struct {
+	rsa      *rsa.PrivateKey
+	ec       *ecdsa.PrivateKey
+	otherRsa *rsa.PrivateKey
+}
+
+func newJwtTestKeys(t *testing.T) jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRsa, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtTestKeys{rsa: rsaKey, ec: ecKey, otherRsa: otherRsa}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJwk(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig", Alg: "RS256", N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJwk(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(key.X.FillBytes(make([]byte, 32))), Y: b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func writeJwks(t *testing.T, path string, keys ...jsonWebKey) {
+	data, err := json.Marshal(jsonWebKeySet{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Signs the claims with an RSA or EC private key, as alg says
+func signJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func jwtTestClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":         "https://issuer.example",
+		"aud":         "reporter",
+		"sub":         "someone",
+		"exp":         jwtTestNow.Add(time.Hour).Unix(),
+		"territories": []string{"acme"},
+		"scope":       "openid read export",
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func newTestJwtVerifier(t *testing.T, keys jwtTestKeys, conf JwtConf) (*jwtVerifier, string) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJwks(t, path, rsaJwk("rsa-1", &keys.rsa.PublicKey), ecJwk("ec-1", &keys.ec.PublicKey))
+	conf.Jwks = path
+	if conf.Issuer == "" {
+		conf.Issuer = "https://issuer.example"
+	}
+	if len(conf.Audience) == 0 {
+		conf.Audience = []string{"other", "reporter"}
+	}
+	v, err := newJwtVerifier(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, path
+}
+
+func TestJwtVerify(t *testing.T) {
+	keys := newJwtTestKeys(t)
+	v, _ := newTestJwtVerifier(t, keys, JwtConf{})
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(nil)), true},
+		{"ES256", signJwt(t, "ES256", "ec-1", keys.ec, jwtTestClaims(nil)), true},
+		{"no kid", signJwt(t, "RS256", "", keys.rsa, jwtTestClaims(nil)), true},
+		{"signed by another key", signJwt(t, "RS256", "rsa-1", keys.otherRsa, jwtTestClaims(nil)), false},
+		{"alg doesn't match the key", signJwt(t, "ES256", "rsa-1", keys.rsa, jwtTestClaims(nil)), false},
+		{"RS384", signJwt(t, "RS384", "rsa-1", keys.rsa, jwtTestClaims(nil)), false},
+		{"HS256", signJwt(t, "HS256", "rsa-1", keys.rsa, jwtTestClaims(nil)), false},
+		{"none", strings.Join(strings.Split(signJwt(t, "none", "", keys.rsa, jwtTestClaims(nil)), ".")[:2], ".") + ".", false},
+		{"tampered", tamperJwt(signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(nil))), false},
+		{"wrong issuer", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"no issuer", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"iss": nil})), false},
+		{"wrong audience", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"aud": "someone-else"})), false},
+		{"audience list", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"aud": []string{"x", "reporter"}})), true},
+		{"expired", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"exp": jwtTestNow.Add(-2 * time.Minute).Unix()})), false},
+		{"expired within leeway", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"exp": jwtTestNow.Add(-30 * time.Second).Unix()})), true},
+		{"no expiry", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"nbf": jwtTestNow.Add(5 * time.Minute).Unix()})), false},
+		{"nbf within leeway", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"nbf": jwtTestNow.Add(30 * time.Second).Unix()})), true},
+		{"no territories", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"territories": nil})), false},
+		{"empty territories", signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(map[string]interface{}{"territories": []string{}})), false},
+		{"not a JWT", "abc.def", false},
+	}
+	for _, tt := range tests {
+		_, err := v.verify(tt.token, jwtTestNow)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: verify error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// Changes the payload without changing the signature
+func tamperJwt(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = []byte(strings.Replace(string(payload), `"acme"`, `"other"`, 1))
+	return parts[0] + "." + b64(payload) + "." + parts[2]
+}
+
+func TestJwtClaimMapping(t *testing.T) {
+	keys := newJwtTestKeys(t)
+	tests := []struct {
+		name            string
+		conf            JwtConf
+		claims          map[string]interface{}
+		wantTerritories []string
+		wantScopes      []string
+	}{
+		{"defaults", JwtConf{}, nil, []string{"acme"}, []string{"read", "export"}},
+		{"all territories", JwtConf{}, map[string]interface{}{"territories": []string{"*"}}, nil, []string{"read", "export"}},
+		{"territories as a string", JwtConf{}, map[string]interface{}{"territories": "acme,globex"}, []string{"acme", "globex"}, []string{"read", "export"}},
+		{"scopes as a list", JwtConf{}, map[string]interface{}{"scope": []string{"alerts", "admin"}}, []string{"acme"}, []string{"alerts", "admin"}},
+		{"none of our scopes", JwtConf{}, map[string]interface{}{"scope": "openid profile"}, []string{"acme"}, []string{"read"}},
+		{"default scopes", JwtConf{DefaultScopes: []string{"read", "read-messages"}}, map[string]interface{}{"scope": nil}, []string{"acme"}, []string{"read", "read-messages"}},
+		{"custom claims", JwtConf{TerritoriesClaim: "https://reporter/territories", ScopesClaim: "permissions"},
+			map[string]interface{}{"https://reporter/territories": []string{"globex"}, "permissions": []string{"export"}}, []string{"globex"}, []string{"export"}},
+	}
+	for _, tt := range tests {
+		v, _ := newTestJwtVerifier(t, keys, tt.conf)
+		p, err := v.verify(signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(tt.claims)), jwtTestNow)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(p.Territories, ",") != strings.Join(tt.wantTerritories, ",") || strings.Join(p.Scopes, ",") != strings.Join(tt.wantScopes, ",") {
+			t.Errorf("%s: territories %v and scopes %v, want %v and %v", tt.name, p.Territories, p.Scopes, tt.wantTerritories, tt.wantScopes)
+		}
+		if p.Id != "jwt:someone" || !p.Expires.Equal(jwtTestNow.Add(time.Hour).Add(time.Minute).Truncate(time.Second)) {
+			t.Errorf("%s: id %q, expires %s", tt.name, p.Id, p.Expires)
+		}
+	}
+
+	// The custom territories claim is required when configured
+	v, _ := newTestJwtVerifier(t, keys, JwtConf{TerritoriesClaim: "https://reporter/territories"})
+	if _, err := v.verify(signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(nil)), jwtTestNow); err == nil {
+		t.Error("a token without the configured territories claim was accepted")
+	}
+}
+
+func TestJwtKeyRotation(t *testing.T) {
+	keys := newJwtTestKeys(t)
+	v, path := newTestJwtVerifier(t, keys, JwtConf{})
+	token := signJwt(t, "RS256", "rsa-2", keys.otherRsa, jwtTestClaims(nil))
+
+	// A new key isn't known until the JWKS is fetched again
+	writeJwks(t, path, rsaJwk("rsa-2", &keys.otherRsa.PublicKey))
+	if _, err := v.verify(token, jwtTestNow); err == nil {
+		t.Fatal("a key that hasn't been fetched yet was used")
+	}
+
+	// Once a minute has passed since the last fetch, an unknown kid fetches the JWKS again
+	v.mu.Lock()
+	v.lastFetch = time.Now().Add(-2 * jwksMissRefresh)
+	v.mu.Unlock()
+	if _, err := v.verify(token, jwtTestNow); err != nil {
+		t.Errorf("the new key wasn't fetched: %v", err)
+	}
+	// And the old one has gone
+	if _, err := v.verify(signJwt(t, "RS256", "rsa-1", keys.rsa, jwtTestClaims(nil)), jwtTestNow); err == nil {
+		t.Error("a key that was removed from the JWKS was still used")
+	}
+
+	// A JWKS that can't be read leaves the keys as they were
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v.mu.Lock()
+	v.lastFetch = time.Now().Add(-2 * jwksMissRefresh)
+	v.fetched = time.Now().Add(-2 * v.refresh)
+	v.mu.Unlock()
+	if _, err := v.verify(token, jwtTestNow); err != nil {
+		t.Errorf("a bad JWKS replaced the keys: %v", err)
+	}
+}
+
+func TestNewJwtVerifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only too small (or unsupported) keys means there's nothing to check tokens with
+	writeJwks(t, path, rsaJwk("small", &small.PublicKey), jsonWebKey{Kty: "oct", Kid: "secret"})
+	if _, err := newJwtVerifier(JwtConf{Jwks: path, Issuer: "i", Audience: []string{"a"}}); err == nil {
+		t.Error("a JWKS without any usable keys was accepted")
+	}
+	if _, err := newJwtVerifier(JwtConf{Jwks: path, Audience: []string{"a"}}); err == nil {
+		t.Error("a config without an issuer was accepted")
+	}
+	if _, err := newJwtVerifier(JwtConf{Jwks: path, Issuer: "i", Audience: []string{"a"}, DefaultScopes: []string{"everything"}}); err == nil {
+		t.Error("an unknown default scope was accepted")
+	}
+}
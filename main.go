@@ -23,57 +23,62 @@ import (
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/bugsnag/bugsnag-go"
 	"github.com/fatih/color"
+	"io/ioutil"
 	"log"
 	"net/http"
 	//_ "net/http/pprof"
 	"os"
+	"path/filepath"
 	//"runtime"
 	"strconv"
+	"time"
 )
 
 var socialHarvest = config.SocialHarvest{}
 
-// --------- API Basic Auth Middleware (valid keys are defined in the Social Harvest config, there are no roles or anything)
+// --------- API Basic Auth Middleware (valid keys are defined in the Social Harvest config, what each can do is checked by the routes, see auth.go)
+// Nothing about a request is kept on the middleware, it's shared by every request.
 type BasicAuthMw struct {
 	Realm string
-	Key   string
 }
 
 func (bamw *BasicAuthMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
 	return func(w rest.ResponseWriter, r *rest.Request) {
-
-		authHeader := r.Header.Get("Authorization")
-		log.Println(authHeader)
-		if authHeader == "" {
-			queryParams := r.URL.Query()
-			if len(queryParams["apiKey"]) > 0 {
-				bamw.Key = queryParams["apiKey"][0]
-			} else {
-				bamw.unauthorized(w)
-				return
-			}
-		} else {
-			bamw.Key = authHeader
+		// Already authenticated with a token (see JwtAuthMw)
+		if requestPrincipal(r) != nil {
+			handler(w, r)
+			return
 		}
 
-		keyFound := false
-		for _, key := range socialHarvest.Config.ReporterServer.AuthKeys {
-			if bamw.Key == key {
-				keyFound = true
-			}
+		key, err := requestCredentials(r)
+		if err != nil {
+			bamw.unauthorized(w, err == errBadCredentials)
+			return
 		}
 
-		if !keyFound {
-			bamw.unauthorized(w)
+		principal := findPrincipal(key)
+		if principal == nil {
+			bamw.unauthorized(w, true)
+			return
+		}
+		if err := principal.expired(time.Now()); err != nil {
+			rest.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
+		r.Env[authEnvKey] = principal
 
 		handler(w, r)
 	}
 }
 
-func (bamw *BasicAuthMw) unauthorized(w rest.ResponseWriter) {
-	w.Header().Set("WWW-Authenticate", "Basic realm="+bamw.Realm)
+// Challenges for both schemes, with the Bearer error (RFC 6750) when credentials were sent but weren't any good
+func (bamw *BasicAuthMw) unauthorized(w rest.ResponseWriter, invalid bool) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="`+bamw.Realm+`", charset="UTF-8"`)
+	if invalid {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+bamw.Realm+`", error="invalid_token"`)
+	} else {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="`+bamw.Realm+`"`)
+	}
 	rest.Error(w, "Not Authorized", http.StatusUnauthorized)
 }
 
@@ -86,14 +91,18 @@ func main() {
 	flag.StringVar(&confFile, "conf", "social-harvest-conf.json", "Path to the Social Harvest configuration file.")
 	flag.Parse()
 
-	// Open the config JSON and decode it.
-	file, _ := os.Open(confFile)
-	decoder := json.NewDecoder(file)
+	// Open the config JSON and decode it (both the shared config and the reporter only settings come from the same file).
+	confJson, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		log.Println("error:", err)
+	}
 	configuration := config.SocialHarvestConf{}
-	err := decoder.Decode(&configuration)
+	err = json.Unmarshal(confJson, &configuration)
 	if err != nil {
 		log.Println("error:", err)
 	}
+	json.Unmarshal(confJson, &reporterConfig)
+	reporterConfigDir = filepath.Dir(confFile)
 
 	// Set the configuration, DB client, etc. so that it is available to other stuff.
 	socialHarvest.Config = configuration
@@ -108,6 +117,16 @@ func main() {
 		})
 	}
 
+	// Command line reporting/exporting (anything left after the flags is a command), the API server isn't started
+	if flag.NArg() > 0 {
+		newDatabase(socialHarvest.Config)
+		code := runCommand(flag.Args(), os.Stdout, os.Stderr)
+		if db.Postgres != nil {
+			db.Postgres.Close()
+		}
+		os.Exit(code)
+	}
+
 	// Debug - do not compile with this
 	// runtime.SetBlockProfileRate(1)
 	// // Start a profile server so information can be viewed using a web browser
@@ -131,10 +150,51 @@ func main() {
 		defer db.Postgres.Close()
 	}
 
+	// Scheduled reports run against the same routes, in process (and without any of the auth middleware)
+	if len(reporterConfig.ReporterServer.Scheduler.Jobs) > 0 {
+		reportHandler := rest.ResourceHandler{
+			EnableRelaxedContentType: true,
+		}
+		err = reportHandler.SetRoutes(apiRoutes()...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheduler, err = newReportScheduler(reporterConfig.ReporterServer.Scheduler, &reportHandler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheduler.Start()
+		defer scheduler.Stop()
+		log.Println("Scheduled " + strconv.Itoa(len(reporterConfig.ReporterServer.Scheduler.Jobs)) + " report(s)")
+	}
+
+	// Threshold alerts (rules can also be added through the API, so alerts are on whenever webhooks or rules are configured)
+	alertsConf := reporterConfig.ReporterServer.Alerts
+	if len(alertsConf.Rules) > 0 || len(alertsConf.Webhooks) > 0 {
+		alerts, err = newAlertManager(alertsConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alerts.Start()
+		defer alerts.Stop()
+		log.Println("Evaluating " + strconv.Itoa(len(alertsConf.Rules)) + " alert rule(s)")
+	}
+
+	// Wake up the live message streams when new messages are saved (optional, they poll regardless)
+	if reporterConfig.ReporterServer.Stream.NotifyChannel != "" && db.Postgres != nil {
+		listener, err := listenForMessages(socialHarvest.Config, reporterConfig.ReporterServer.Stream.NotifyChannel)
+		if err != nil {
+			log.Println(err)
+		} else {
+			defer listener.Close()
+		}
+	}
+
 	// The RESTful API reporter server can be completely disabled by setting {"reporterServer":{"disabled": true}} in the config
-	// TODO: Think about accepting command line arguments for reporting/exporting.
+	// (reports can still be run from the command line, see cli.go)
 	if !socialHarvest.Config.ReporterServer.Disabled {
-		restMiddleware := []rest.Middleware{}
+		// ?apiKey= comes out of the URL first thing (the access log would otherwise log it)
+		restMiddleware := []rest.Middleware{&QueryKeyMw{}}
 
 		// If additional origins were allowed for CORS, handle them
 		if len(socialHarvest.Config.ReporterServer.Cors.AllowedOrigins) > 0 {
@@ -150,53 +210,72 @@ func main() {
 						}
 						return false
 					},
-					AllowedMethods: []string{"GET", "POST", "PUT"},
+					AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
 					AllowedHeaders: []string{
-						"Accept", "Content-Type", "X-Custom-Header", "Origin"},
+						"Accept", "Authorization", "Content-Type", "X-Custom-Header", "Origin"},
 					AccessControlAllowCredentials: true,
 					AccessControlMaxAge:           3600,
 				},
 			)
 		}
-		// If api keys are defined, setup basic auth (any key listed allows full access, there are no roles for now, this is just very basic auth)
-		if len(socialHarvest.Config.ReporterServer.AuthKeys) > 0 {
+		// Rate limits by IP go ahead of auth, by key after it
+		rateLimits, err = newRateLimiter(reporterConfig.ReporterServer.RateLimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rateLimits != nil {
+			restMiddleware = append(restMiddleware, &RateLimitMw{Limiter: rateLimits})
+		}
+
+		// If api keys are defined, setup basic auth (keys in authKeys allow full access, apiKeys can be limited)
+		apiKeys, err = loadApiKeys(socialHarvest.Config.ReporterServer.AuthKeys, reporterConfig.ReporterServer.ApiKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// JWT auth comes first so tokens don't get mistaken for API keys
+		if reporterConfig.ReporterServer.Jwt.Jwks != "" {
+			jwtAuth, err = newJwtVerifier(reporterConfig.ReporterServer.Jwt)
+			if err != nil {
+				log.Fatal(err)
+			}
+			restMiddleware = append(restMiddleware,
+				&JwtAuthMw{
+					Realm:    "Social Harvest (reporter) API",
+					Verifier: jwtAuth,
+					Fallback: len(apiKeys) > 0,
+				},
+			)
+		}
+		if len(apiKeys) > 0 {
 			restMiddleware = append(restMiddleware,
 				&BasicAuthMw{
 					Realm: "Social Harvest (reporter) API",
-					Key:   "",
 				},
 			)
 		}
 
+		if rateLimits != nil {
+			restMiddleware = append(restMiddleware, &RateLimitMw{Limiter: rateLimits, ByKey: true})
+		}
+
 		handler := rest.ResourceHandler{
 			EnableRelaxedContentType: true,
 			PreRoutingMiddlewares:    restMiddleware,
 		}
-		err := handler.SetRoutes(
-
-			&rest.Route{"GET", "/database/info", DatabaseInfo},
-			&rest.Route{"GET", "/territory/list", TerritoryList},
-			&rest.Route{"GET", "/link/details", LinkDetails},
-
-			// Simple counts for a territory
-			&rest.Route{"GET", "/territory/count/:territory/:series/:field", TerritoryCountData},
-			&rest.Route{"GET", "/territory/timeseries/count/:territory/:series/:field", TerritoryTimeseriesCountData},
-			// Grouped counts
-			&rest.Route{"GET", "/territory/aggregate/:territory/:series", TerritoryAggregateData},
-			// Top values for a territory
-			// All of these use the same aggregate query, some routes have extra parameters not easily expressed in a querystring...
-			// Of course we could use a POST with JSON, but this is more convenient. other routes are merely convenience and could instead use the aggregate endpoint.
-			&rest.Route{"GET", "/territory/top/images/:territory", TerritoryTopImages},
-			&rest.Route{"GET", "/territory/top/videos/:territory", TerritoryTopVideos},
-			&rest.Route{"GET", "/territory/top/audio/:territory", TerritoryTopAudio},
-			&rest.Route{"GET", "/territory/top/links/:territory", TerritoryTopLinks},
-			&rest.Route{"GET", "/territory/top/keywords/:territory", TerritoryTopKeywords},
-			&rest.Route{"GET", "/territory/top/hashtags/:territory", TerritoryTopHashtags},
-			// This comes with some options like "precision" which will adjust the clustering (geohash string length)
-			&rest.Route{"GET", "/territory/top/locations/:territory", TerritoryTopLocations},
-			// Messages for a territory
-			&rest.Route{"GET", "/territory/messages/:territory", TerritoryMessages},
-		)
+
+		// The audit log goes around everything so it also records requests turned away by auth or rate limits
+		audit, err = newAuditLog(reporterConfig.ReporterServer.Audit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if audit != nil {
+			audit.Start()
+			defer audit.Stop()
+			handler.OuterMiddlewares = []rest.Middleware{
+				&AuditMw{Log: audit, ProxyHops: proxyHops(reporterConfig.ReporterServer.RateLimit)},
+			}
+		}
+		err := handler.SetRoutes(apiRoutes()...)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -213,5 +292,70 @@ func main() {
 		} else {
 			log.Fatal(http.ListenAndServe(":"+p, &handler))
 		}
+	} else if scheduler != nil || alerts != nil {
+		// Keep running for the scheduled reports and alerts
+		select {}
+	}
+}
+
+// Returns all of the API routes (used by the server and the report scheduler). Each belongs to a group of routes an API key
+// can be allowed (see auth.go).
+func apiRoutes() []*rest.Route {
+	return []*rest.Route{
+		&rest.Route{"GET", "/database/info", scoped(scopeRead, DatabaseInfo)},
+		&rest.Route{"GET", "/territory/list", scoped(scopeRead, TerritoryList)},
+		// Audience overlap between territories (?territories=a,b,...)
+		&rest.Route{"GET", "/territory/overlap", scoped(scopeRead, TerritoryOverlap)},
+		&rest.Route{"GET", "/link/details", scoped(scopeRead, LinkDetails)},
+
+		// Simple counts for a territory
+		&rest.Route{"GET", "/territory/count/:territory/:series/:field", scoped(scopeRead, TerritoryCountData)},
+		&rest.Route{"GET", "/territory/timeseries/count/:territory/:series/:field", scoped(scopeRead, TerritoryTimeseriesCountData)},
+		// Grouped counts
+		&rest.Route{"GET", "/territory/aggregate/:territory/:series", scoped(scopeRead, TerritoryAggregateData)},
+		// Top values for a territory
+		// All of these use the same aggregate query, some routes have extra parameters not easily expressed in a querystring...
+		// Of course we could use a POST with JSON, but this is more convenient. other routes are merely convenience and could instead use the aggregate endpoint.
+		&rest.Route{"GET", "/territory/top/images/:territory", scoped(scopeRead, TerritoryTopImages)},
+		&rest.Route{"GET", "/territory/top/videos/:territory", scoped(scopeRead, TerritoryTopVideos)},
+		&rest.Route{"GET", "/territory/top/audio/:territory", scoped(scopeRead, TerritoryTopAudio)},
+		&rest.Route{"GET", "/territory/top/links/:territory", scoped(scopeRead, TerritoryTopLinks)},
+		&rest.Route{"GET", "/territory/top/keywords/:territory", scoped(scopeRead, TerritoryTopKeywords)},
+		&rest.Route{"GET", "/territory/top/hashtags/:territory", scoped(scopeRead, TerritoryTopHashtags)},
+		// Contributors can be ranked by message count, reach or engagement using the "sort" option
+		&rest.Route{"GET", "/territory/top/contributors/:territory", scoped(scopeRead, TerritoryTopContributors)},
+		// This comes with some options like "precision" which will adjust the clustering (geohash string length)
+		&rest.Route{"GET", "/territory/top/locations/:territory", scoped(scopeRead, TerritoryTopLocations)},
+		// Messages for a territory
+		&rest.Route{"GET", "/territory/messages/:territory", scoped(scopeReadMessages, TerritoryMessages)},
+		&rest.Route{"GET", "/territory/messages/:territory/:message_id", scoped(scopeReadMessages, TerritoryMessage)},
+		// Newly harvested messages as they come in (Server-Sent Events or WebSocket)
+		&rest.Route{"GET", "/territory/stream/:territory", scoped(scopeReadMessages, TerritoryMessageStream)},
+		// Bulk export of all messages for a territory (streamed, not paginated)
+		&rest.Route{"GET", "/territory/export/messages/:territory", scoped(scopeExport, TerritoryMessagesExport)},
+		// A single contributor (?territory= is required)
+		&rest.Route{"GET", "/territory/contributor/:network/:contributor", scoped(scopeReadMessages, TerritoryContributor)},
+		// When the audience for a territory is active (day of week by hour of day)
+		&rest.Route{"GET", "/territory/activity/heatmap/:territory", scoped(scopeRead, TerritoryActivityHeatmap)},
+		// Contributor retention, grouped by the week or month they first appeared in
+		&rest.Route{"GET", "/territory/cohorts/:territory", scoped(scopeRead, TerritoryCohorts)},
+		// Rendered (HTML/PDF) report for a territory
+		&rest.Route{"GET", "/territory/report/:territory", scoped(scopeExport, TerritoryReportDocument)},
+		// Charts (SVG or PNG) for embedding, these take the same params as the routes they mirror
+		&rest.Route{"GET", "/chart/timeseries/count/:territory/:series/:field", scoped(scopeRead, ChartTimeseriesCount)},
+		&rest.Route{"GET", "/chart/sparkline/count/:territory/:series/:field", scoped(scopeRead, ChartSparklineCount)},
+		&rest.Route{"GET", "/chart/aggregate/:territory/:series", scoped(scopeRead, ChartAggregate)},
+		&rest.Route{"GET", "/chart/top/:list/:territory", scoped(scopeRead, ChartTop)},
+		// Threshold alerts
+		&rest.Route{"GET", "/alerts", scoped(scopeAlerts, AlertRules)},
+		&rest.Route{"POST", "/alerts", scoped(scopeAlerts, AlertRuleCreate)},
+		&rest.Route{"DELETE", "/alerts/:name", scoped(scopeAlerts, AlertRuleDelete)},
+		&rest.Route{"GET", "/alerts/events", scoped(scopeAlerts, AlertEvents)},
+		// Scheduled reports and their run history
+		&rest.Route{"GET", "/reports/jobs", scoped(scopeAdmin, ReportJobs)},
+		&rest.Route{"GET", "/reports/jobs/:name/runs", scoped(scopeAdmin, ReportJobRuns)},
+		// Requests today and what's left of the rate limits for each key
+		&rest.Route{"GET", "/admin/usage", scoped(scopeAdmin, RateLimitUsageData)},
+		&rest.Route{"GET", "/admin/audit", scoped(scopeAdmin, AuditLogData)},
 	}
 }
@@ -0,0 +1,400 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the rate limiting, so one busy client can't take up the whole database. Each client IP and each API key
+// (or token) gets a token bucket and keys also get a daily quota of requests. Responses carry RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers for whichever limit is closest and a 429 with a Retry-After once a limit is reached.
+package main
+
+import (
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets that have been idle (and so are full again) are forgotten this often
+const rateLimitSweep = 10 * time.Minute
+
+// A token bucket: it holds up to burst requests and refills at rate requests a second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A limit from the config, ready to use
+type rateLimit struct {
+	// Requests a second
+	rate  float64
+	burst float64
+}
+
+func newRateLimit(rule RateLimitRule) (rateLimit, error) {
+	if rule.Requests <= 0 {
+		return rateLimit{}, nil
+	}
+	per := time.Second
+	if rule.Per != "" {
+		var err error
+		per, err = time.ParseDuration(rule.Per)
+		if err != nil || per <= 0 {
+			return rateLimit{}, errors.New("Invalid rate limit period (a Go duration like 1m): " + rule.Per)
+		}
+	}
+	burst := rule.Burst
+	if burst <= 0 {
+		burst = rule.Requests
+	}
+	return rateLimit{rate: float64(rule.Requests) / per.Seconds(), burst: float64(burst)}, nil
+}
+
+func (l rateLimit) enabled() bool {
+	return l.rate > 0
+}
+
+// Where a request stands against a limit
+type rateLimitStatus struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	// Seconds until the bucket is full again (or the quota resets)
+	Reset int `json:"reset"`
+	// Seconds until a request would be allowed, 0 if this one was
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// Takes a request from the bucket if there's one to take
+func (l rateLimit) take(b *tokenBucket, now time.Time) rateLimitStatus {
+	if b.last.IsZero() {
+		b.tokens = l.burst
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+
+	status := rateLimitStatus{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		status.RetryAfter = int(math.Ceil((1 - b.tokens) / l.rate))
+	}
+	status.Remaining = int(math.Floor(b.tokens))
+	status.Reset = int(math.Ceil((l.burst - b.tokens) / l.rate))
+	return status
+}
+
+// How much of its daily quota a key has used
+type keyUsage struct {
+	Day      string `json:"day"`
+	Requests int    `json:"requests"`
+	Limited  int    `json:"limited"`
+}
+
+// The rate limits, quotas and usage
+type rateLimiter struct {
+	perKey     rateLimit
+	perIp      rateLimit
+	dailyQuota int
+	proxyHops  int
+
+	mu        sync.Mutex
+	keys      map[string]*tokenBucket
+	ips       map[string]*tokenBucket
+	usage     map[string]*keyUsage
+	lastSweep time.Time
+}
+
+// The limiter for the configured limits, nil when there aren't any
+var rateLimits *rateLimiter
+
+func newRateLimiter(conf RateLimitConf) (*rateLimiter, error) {
+	perKey, err := newRateLimit(conf.PerKey)
+	if err != nil {
+		return nil, err
+	}
+	perIp, err := newRateLimit(conf.PerIp)
+	if err != nil {
+		return nil, err
+	}
+	if !perKey.enabled() && !perIp.enabled() && conf.DailyQuota <= 0 {
+		return nil, nil
+	}
+	return &rateLimiter{
+		perKey:     perKey,
+		perIp:      perIp,
+		dailyQuota: conf.DailyQuota,
+		proxyHops:  proxyHops(conf),
+		keys:       map[string]*tokenBucket{},
+		ips:        map[string]*tokenBucket{},
+		usage:      map[string]*keyUsage{},
+		lastSweep:  time.Now(),
+	}, nil
+}
+
+// How many proxies in front of the reporter can be trusted to add to X-Forwarded-For (0 when it isn't trusted at all)
+func proxyHops(conf RateLimitConf) int {
+	if !conf.TrustProxy {
+		return 0
+	}
+	if conf.ProxyHops <= 0 {
+		return 1
+	}
+	return conf.ProxyHops
+}
+
+// The client's IP. Behind trusted proxies it's the X-Forwarded-For entry added by the outermost one, counting from the right,
+// since the client can put anything it likes at the start of the header.
+func requestIp(r *rest.Request, hops int) string {
+	if hops > 0 {
+		forwarded := []string{}
+		for _, header := range r.Header["X-Forwarded-For"] {
+			for _, entry := range strings.Split(header, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					forwarded = append(forwarded, entry)
+				}
+			}
+		}
+		if len(forwarded) > 0 {
+			// Fewer entries than proxies means they were all added by proxies, so the first is the client
+			if hops > len(forwarded) {
+				hops = len(forwarded)
+			}
+			return forwarded[len(forwarded)-hops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Forgets buckets that have been idle long enough to be full again (the lock must be held)
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweep {
+		return
+	}
+	rl.lastSweep = now
+	for _, set := range []struct {
+		buckets map[string]*tokenBucket
+		limit   rateLimit
+	}{{rl.keys, rl.perKey}, {rl.ips, rl.perIp}} {
+		for id, b := range set.buckets {
+			if set.limit.enabled() && now.Sub(b.last).Seconds()*set.limit.rate+b.tokens >= set.limit.burst {
+				delete(set.buckets, id)
+			}
+		}
+	}
+	today := now.UTC().Format("2006-01-02")
+	for id, u := range rl.usage {
+		if u.Day != today {
+			delete(rl.usage, id)
+		}
+	}
+}
+
+func (rl *rateLimiter) bucket(buckets map[string]*tokenBucket, id string) *tokenBucket {
+	b, ok := buckets[id]
+	if !ok {
+		b = &tokenBucket{}
+		buckets[id] = b
+	}
+	return b
+}
+
+// Checks a request from an IP
+func (rl *rateLimiter) allowIp(ip string, now time.Time) (rateLimitStatus, bool) {
+	if !rl.perIp.enabled() {
+		return rateLimitStatus{}, true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	status := rl.perIp.take(rl.bucket(rl.ips, ip), now)
+	return status, status.RetryAfter == 0
+}
+
+// Checks a request from a key against its bucket and daily quota. The reason is given when it isn't allowed.
+func (rl *rateLimiter) allowKey(id string, now time.Time) (rateLimitStatus, bool, string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+
+	today := now.UTC().Format("2006-01-02")
+	usage, ok := rl.usage[id]
+	if !ok || usage.Day != today {
+		usage = &keyUsage{Day: today}
+		rl.usage[id] = usage
+	}
+
+	status := rateLimitStatus{}
+	if rl.perKey.enabled() {
+		status = rl.perKey.take(rl.bucket(rl.keys, id), now)
+		if status.RetryAfter > 0 {
+			usage.Limited++
+			return status, false, "Too many requests, slow down"
+		}
+	}
+
+	if rl.dailyQuota > 0 {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		untilMidnight := int(math.Ceil(midnight.Sub(now).Seconds()))
+		if usage.Requests >= rl.dailyQuota {
+			usage.Limited++
+			return rateLimitStatus{Limit: rl.dailyQuota, Reset: untilMidnight, RetryAfter: untilMidnight}, false, "The daily quota of " + strconv.Itoa(rl.dailyQuota) + " requests has been used"
+		}
+		// The quota is reported when it's closer than the bucket
+		if remaining := rl.dailyQuota - usage.Requests - 1; !rl.perKey.enabled() || remaining < status.Remaining {
+			status = rateLimitStatus{Limit: rl.dailyQuota, Remaining: remaining, Reset: untilMidnight}
+		}
+	}
+	usage.Requests++
+	return status, true, ""
+}
+
+// Usage for the admin endpoint
+type RateLimitUsage struct {
+	Id       string `json:"id"`
+	Requests int    `json:"requests"`
+	Limited  int    `json:"limited"`
+	// What's left in the key's bucket and daily quota (-1 when there's no limit)
+	Remaining      int `json:"remaining"`
+	QuotaRemaining int `json:"quotaRemaining"`
+}
+
+// Returns today's usage for each key (busiest first) and how many IPs are being tracked
+func (rl *rateLimiter) Usage(now time.Time) ([]RateLimitUsage, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	today := now.UTC().Format("2006-01-02")
+	usage := []RateLimitUsage{}
+	for id, u := range rl.usage {
+		if u.Day != today {
+			continue
+		}
+		entry := RateLimitUsage{Id: id, Requests: u.Requests, Limited: u.Limited, Remaining: -1, QuotaRemaining: -1}
+		if b, ok := rl.keys[id]; ok && rl.perKey.enabled() {
+			entry.Remaining = int(math.Floor(math.Min(rl.perKey.burst, b.tokens+now.Sub(b.last).Seconds()*rl.perKey.rate)))
+		}
+		if rl.dailyQuota > 0 {
+			entry.QuotaRemaining = rl.dailyQuota - u.Requests
+			if entry.QuotaRemaining < 0 {
+				entry.QuotaRemaining = 0
+			}
+		}
+		usage = append(usage, entry)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Requests != usage[j].Requests {
+			return usage[i].Requests > usage[j].Requests
+		}
+		return usage[i].Id < usage[j].Id
+	})
+	return usage, len(rl.ips)
+}
+
+// Sets the RateLimit headers, unless a limit closer to running out has already set them
+func setRateLimitHeaders(w rest.ResponseWriter, status rateLimitStatus) {
+	if status.Limit == 0 {
+		return
+	}
+	if existing := w.Header().Get("RateLimit-Remaining"); existing != "" {
+		if remaining, err := strconv.Atoi(existing); err == nil && remaining <= status.Remaining {
+			return
+		}
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(status.Reset))
+}
+
+func rateLimited(w rest.ResponseWriter, status rateLimitStatus, reason string) {
+	setRateLimitHeaders(w, status)
+	w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+	rest.Error(w, reason, http.StatusTooManyRequests)
+}
+
+// --------- API Rate Limit Middleware. It's used twice: by IP ahead of auth (so guessing keys is slow too) and by key after it.
+type RateLimitMw struct {
+	Limiter *rateLimiter
+	ByKey   bool
+}
+
+func (rlmw *RateLimitMw) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		now := time.Now()
+		if rlmw.ByKey {
+			// Without auth there are no keys, only IPs
+			if p := requestPrincipal(r); p != nil {
+				status, ok, reason := rlmw.Limiter.allowKey(p.Id, now)
+				if !ok {
+					rateLimited(w, status, reason)
+					return
+				}
+				setRateLimitHeaders(w, status)
+			}
+		} else {
+			status, ok := rlmw.Limiter.allowIp(requestIp(r, rlmw.Limiter.proxyHops), now)
+			if !ok {
+				rateLimited(w, status, "Too many requests from this address, slow down")
+				return
+			}
+			setRateLimitHeaders(w, status)
+		}
+		handler(w, r)
+	}
+}
+
+// --------- API end points ---------
+
+// Returns today's requests and what's left of the limits for each key
+func RateLimitUsageData(w rest.ResponseWriter, r *rest.Request) {
+	res := setAdminLinks("admin:usage")
+	if rateLimits == nil {
+		res.Data["keys"] = []RateLimitUsage{}
+		res.Data["ips"] = 0
+	} else {
+		now := time.Now()
+		res.Data["keys"], res.Data["ips"] = rateLimits.Usage(now)
+		res.Data["day"] = now.UTC().Format("2006-01-02")
+		res.Data["dailyQuota"] = rateLimits.dailyQuota
+	}
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+func setAdminLinks(self string) *config.HypermediaResource {
+	res := config.NewHypermediaResource()
+	links := map[string]config.HypermediaLink{
+		"admin:usage": {Href: "/admin/usage"},
+		"admin:audit": {Href: "/admin/audit{?key,from,to,tz,limit}"},
+	}
+	for link, l := range links {
+		if link == self {
+			res.Links["self"] = l
+		} else {
+			res.Links[link] = l
+		}
+	}
+	return res
+}
@@ -0,0 +1,175 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	// 1 request a second with bursts of 3
+	l, err := newRateLimit(RateLimitRule{Requests: 60, Per: "1m", Burst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2014, 10, 15, 12, 0, 0, 0, time.UTC)
+	b := &tokenBucket{}
+	for i, remaining := range []int{2, 1, 0} {
+		status := l.take(b, now)
+		if status.RetryAfter != 0 || status.Remaining != remaining || status.Limit != 3 {
+			t.Fatalf("request %d: got %+v, expected it allowed with %d remaining", i, status, remaining)
+		}
+	}
+	status := l.take(b, now)
+	if status.RetryAfter != 1 || status.Remaining != 0 || status.Reset != 3 {
+		t.Fatalf("over the burst: got %+v, expected a retry after 1s and a reset in 3s", status)
+	}
+	// Half a second later there's still not a whole token
+	if status = l.take(b, now.Add(500*time.Millisecond)); status.RetryAfter == 0 {
+		t.Fatalf("after 0.5s: got %+v, expected it limited", status)
+	}
+	if status = l.take(b, now.Add(1500*time.Millisecond)); status.RetryAfter != 0 {
+		t.Fatalf("after 1.5s: got %+v, expected it allowed", status)
+	}
+	// Idle long enough to be full again, but never more than the burst
+	if status = l.take(b, now.Add(time.Hour)); status.RetryAfter != 0 || status.Remaining != 2 {
+		t.Fatalf("after an hour: got %+v, expected 2 remaining", status)
+	}
+}
+
+func TestNewRateLimit(t *testing.T) {
+	if l, err := newRateLimit(RateLimitRule{}); err != nil || l.enabled() {
+		t.Errorf("an empty rule: got %+v, %v, expected no limit", l, err)
+	}
+	if l, err := newRateLimit(RateLimitRule{Requests: 10}); err != nil || l.rate != 10 || l.burst != 10 {
+		t.Errorf("10 a second: got %+v, %v", l, err)
+	}
+	if _, err := newRateLimit(RateLimitRule{Requests: 10, Per: "soon"}); err == nil {
+		t.Error("expected an error for an invalid period")
+	}
+}
+
+func TestAllowKey(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConf{PerKey: RateLimitRule{Requests: 2, Per: "1s"}, DailyQuota: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2014, 10, 15, 23, 59, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if status, ok, reason := rl.allowKey("a", now); !ok {
+			t.Fatalf("request %d: got %+v (%s), expected it allowed", i, status, reason)
+		}
+	}
+	status, ok, _ := rl.allowKey("a", now)
+	if ok || status.RetryAfter != 1 {
+		t.Fatalf("over the bucket: got %+v, %v, expected a retry after 1s", status, ok)
+	}
+	// Each key has its own bucket
+	if _, ok, _ := rl.allowKey("b", now); !ok {
+		t.Fatal("expected another key to be allowed")
+	}
+
+	// The bucket has refilled but there's only one request left of the quota, which is what's reported
+	now = now.Add(2 * time.Second)
+	status, ok, _ = rl.allowKey("a", now)
+	if !ok || status.Limit != 3 || status.Remaining != 0 || status.Reset != 58 {
+		t.Fatalf("last of the quota: got %+v, %v, expected the quota with 0 remaining, resetting in 58s", status, ok)
+	}
+	now = now.Add(2 * time.Second)
+	status, ok, reason := rl.allowKey("a", now)
+	if ok || status.RetryAfter != 56 || reason == "" {
+		t.Fatalf("over the quota: got %+v, %v, expected a retry at midnight", status, ok)
+	}
+
+	usage, _ := rl.Usage(now)
+	if len(usage) != 2 || usage[0].Id != "a" || usage[0].Requests != 3 || usage[0].Limited != 2 || usage[0].QuotaRemaining != 0 {
+		t.Fatalf("got usage %+v", usage)
+	}
+
+	// The quota starts over at midnight UTC
+	if status, ok, _ := rl.allowKey("a", now.Add(time.Minute)); !ok {
+		t.Fatalf("the next day: got %+v, expected it allowed", status)
+	}
+}
+
+func TestAllowIp(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConf{PerIp: RateLimitRule{Requests: 1, Per: "1m"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, ok := rl.allowIp("10.0.0.1", now); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if _, ok := rl.allowIp("10.0.0.1", now); ok {
+		t.Fatal("expected the second request to be limited")
+	}
+	if _, ok := rl.allowIp("10.0.0.2", now); !ok {
+		t.Fatal("expected another IP to be allowed")
+	}
+	if rl, _ := newRateLimiter(RateLimitConf{}); rl != nil {
+		t.Fatal("expected no limiter without any limits")
+	}
+}
+
+func TestRequestIp(t *testing.T) {
+	tests := []struct {
+		forwarded []string
+		hops      int
+		ip        string
+	}{
+		{nil, 0, "192.0.2.1"},
+		// Not trusted, so the header is ignored
+		{[]string{"203.0.113.9"}, 0, "192.0.2.1"},
+		{nil, 1, "192.0.2.1"},
+		{[]string{"203.0.113.9"}, 1, "203.0.113.9"},
+		// Whatever the client sent comes first, the proxy's entry is on the right
+		{[]string{"10.9.9.9, 203.0.113.9"}, 1, "203.0.113.9"},
+		{[]string{"10.9.9.9", "203.0.113.9"}, 1, "203.0.113.9"},
+		{[]string{"10.9.9.9, 203.0.113.9, 198.51.100.7"}, 2, "203.0.113.9"},
+		{[]string{"203.0.113.9, 198.51.100.7"}, 3, "203.0.113.9"},
+		{[]string{" , 203.0.113.9 "}, 1, "203.0.113.9"},
+	}
+	for _, test := range tests {
+		r := newTestRequest(t, "http://localhost/territory/list", "")
+		r.RemoteAddr = "192.0.2.1:52000"
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if ip := requestIp(r, test.hops); ip != test.ip {
+			t.Errorf("requestIp(%q, %d) = %s, expected %s", test.forwarded, test.hops, ip, test.ip)
+		}
+	}
+}
+
+func TestProxyHops(t *testing.T) {
+	for _, test := range []struct {
+		conf RateLimitConf
+		hops int
+	}{
+		{RateLimitConf{}, 0},
+		{RateLimitConf{ProxyHops: 2}, 0},
+		{RateLimitConf{TrustProxy: true}, 1},
+		{RateLimitConf{TrustProxy: true, ProxyHops: 2}, 2},
+	} {
+		if hops := proxyHops(test.conf); hops != test.hops {
+			t.Errorf("proxyHops(%+v) = %d, expected %d", test.conf, hops, test.hops)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the rendered (HTML and PDF) territory reports.
+// The default template can be overridden by putting a templates/report.html file next to the config file.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everything that goes into a territory report
+type TerritoryReport struct {
+	Territory    string
+	From         string
+	To           string
+	Timezone     string
+	GeneratedAt  time.Time
+	Total        int
+	Contributors int
+	Networks     []ResultAggregateCount
+	Volume       []ResultAggregateCount
+	VolumeChart  reportChart
+	Hashtags     []ResultAggregateCount
+	Links        []ResultAggregateCount
+	Locations    []ResultAggregateCount
+	Messages     []config.SocialHarvestMessage
+}
+
+// A simple line chart drawn by the template as an inline SVG
+type reportChart struct {
+	Width  int
+	Height int
+	Max    int
+	Points string
+}
+
+func newReportChart(counts []ResultAggregateCount, width int, height int) reportChart {
+	chart := reportChart{Width: width, Height: height}
+	for _, c := range counts {
+		if c.Count > chart.Max {
+			chart.Max = c.Count
+		}
+	}
+	if len(counts) == 0 || chart.Max == 0 {
+		return chart
+	}
+
+	points := make([]string, len(counts))
+	for i, c := range counts {
+		x := 0.0
+		if len(counts) > 1 {
+			x = float64(i) / float64(len(counts)-1) * float64(width)
+		}
+		y := float64(height) - float64(c.Count)/float64(chart.Max)*float64(height)
+		points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	chart.Points = strings.Join(points, " ")
+	return chart
+}
+
+// The network isn't a FieldCounts param, so it goes in as an extra condition (it's checked by buildTerritoryReport first)
+func reportExtraParams(params CommonQueryParams) map[string]string {
+	extraParams := map[string]string{}
+	if params.Network != "" {
+		extraParams["network"] = "= '" + params.Network + "'"
+	}
+	return extraParams
+}
+
+// Returns the counts for one of the top lists (hashtags, links, locations, etc.)
+func topListCounts(kind string, params CommonQueryParams, limit uint64) []ResultAggregateCount {
+	extraParams := reportExtraParams(params)
+	params.Limit = limit
+	fields := applyTopList(kind, &params, extraParams)
+	fieldCounts, _ := db.FieldCounts(params, fields, extraParams)
+	if len(fieldCounts) > 0 {
+		return fieldCounts[0].Count[fields[0]]
+	}
+	return []ResultAggregateCount{}
+}
+
+var errInvalidReportNetwork = errors.New("Invalid network: network names can only contain letters, numbers and underscores")
+
+// Gathers all of the data for a territory report (dates are shown in the range's timezone). Everything in it, the totals and
+// top lists included, is limited to the network when one is given.
+func buildTerritoryReport(params CommonQueryParams, dr dateRange) (TerritoryReport, error) {
+	if params.Network != "" && !groupFieldPattern.MatchString(params.Network) {
+		return TerritoryReport{}, errInvalidReportNetwork
+	}
+	params.Series = "messages"
+	report := TerritoryReport{
+		Territory:   params.Territory,
+		From:        params.From,
+		To:          params.To,
+		Timezone:    dr.Timezone(),
+		GeneratedAt: time.Now().In(dr.Location),
+	}
+	if !dr.from.IsZero() {
+		report.From = dr.from.Format("2006-01-02 15:04")
+	}
+	if !dr.to.IsZero() {
+		report.To = dr.to.Format("2006-01-02 15:04")
+	}
+
+	// Overview
+	overviewParams := params
+	overviewParams.Limit = 20
+	overview, total := db.FieldCounts(overviewParams, []string{"network", "contributor_id"}, reportExtraParams(params))
+	report.Total = total.Count
+	for _, fc := range overview {
+		if networks, ok := fc.Count["network"]; ok {
+			report.Networks = networks
+		}
+		if _, ok := fc.Count["contributor_id"]; ok {
+			report.Contributors = fc.Distinct
+		}
+	}
+
+	report.Volume = db.MessageVolume(params, BasicConditions{}, "day")
+	report.VolumeChart = newReportChart(report.Volume, 720, 160)
+	report.Hashtags = topListCounts("hashtags", params, 10)
+	report.Links = topListCounts("links", params, 10)
+	report.Locations = topListCounts("locations", params, 10)
+
+	sampleParams := params
+	sampleParams.Limit = 10
+	report.Messages, _, _, _ = db.Messages(sampleParams, BasicConditions{})
+	for i := range report.Messages {
+		report.Messages[i].Time = report.Messages[i].Time.In(dr.Location)
+	}
+
+	return report, nil
+}
+
+// Loads the report template, preferring templates/report.html next to the config file over the default
+func reportTemplate() (*template.Template, error) {
+	source := defaultReportTemplate
+	override := filepath.Join(reporterConfigDir, "templates", "report.html")
+	if b, err := ioutil.ReadFile(override); err == nil {
+		source = string(b)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return template.New("report").Funcs(template.FuncMap{
+		"date": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+	}).Parse(source)
+}
+
+// Renders the report as "html" or "pdf" (which needs a pdfCommand in the config)
+func renderTerritoryReport(out io.Writer, report TerritoryReport, format string) error {
+	tmpl, err := reportTemplate()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "html":
+		return tmpl.Execute(out, report)
+	case "pdf":
+		pdfCommand := reporterConfig.ReporterServer.Reports.PdfCommand
+		if len(pdfCommand) == 0 {
+			return errPdfNotConfigured
+		}
+		var html bytes.Buffer
+		if err = tmpl.Execute(&html, report); err != nil {
+			return err
+		}
+		timeout, err := time.ParseDuration(reporterConfig.ReporterServer.Reports.PdfTimeout)
+		if err != nil || timeout <= 0 {
+			timeout = time.Minute
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, pdfCommand[0], pdfCommand[1:]...)
+		cmd.Stdin = &html
+		cmd.Stdout = out
+		cmd.Stderr = &stderr
+		if err = cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return errors.New("pdf rendering took longer than " + timeout.String())
+			}
+			return errors.New("pdf rendering failed: " + err.Error() + " " + strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	return errors.New("unsupported report format: " + format)
+}
+
+var errPdfNotConfigured = errors.New("PDF reports need a pdfCommand configured under reporterServer.reports")
+
+// API: Returns a rendered report for a territory as HTML (the default) or PDF (?format=pdf)
+func TerritoryReportDocument(w rest.ResponseWriter, r *rest.Request) {
+	territory := r.PathParam("territory")
+	queryParams := r.URL.Query()
+
+	format := "html"
+	if len(queryParams["format"]) > 0 && queryParams["format"][0] != "" {
+		format = queryParams["format"][0]
+	}
+	if format != "html" && format != "pdf" {
+		rest.Error(w, "Not Acceptable: reports can be rendered as html or pdf", http.StatusNotAcceptable)
+		return
+	}
+	if format == "pdf" && len(reporterConfig.ReporterServer.Reports.PdfCommand) == 0 {
+		rest.Error(w, errPdfNotConfigured.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+
+	params := CommonQueryParams{
+		Territory: territory,
+		Network:   network,
+	}
+	dr.apply(&params)
+	report, err := buildTerritoryReport(params, dr)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Render fully before writing anything so errors can still be returned properly
+	var out bytes.Buffer
+	err = renderTerritoryReport(&out, report, format)
+	if err != nil {
+		log.Println(err)
+		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+exportFilename(r, "report", format)+`"`)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.(http.ResponseWriter).Write(out.Bytes())
+}
+
+const defaultReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Territory}} - Social Harvest Report</title>
+<style>
+	body { font-family: Helvetica, Arial, sans-serif; color: #333; margin: 40px; }
+	h1 { margin-bottom: 0; }
+	h2 { border-bottom: 1px solid #ddd; padding-bottom: 4px; margin-top: 36px; }
+	.range { color: #888; margin-top: 4px; }
+	.stats { display: flex; gap: 40px; }
+	.stat strong { display: block; font-size: 28px; }
+	table { border-collapse: collapse; width: 100%; }
+	td, th { text-align: left; padding: 4px 8px; border-bottom: 1px solid #eee; }
+	td.count { text-align: right; width: 80px; }
+	.columns { display: flex; gap: 40px; }
+	.columns > div { flex: 1; }
+	.message { border-bottom: 1px solid #eee; padding: 8px 0; }
+	.message .meta { color: #888; font-size: 12px; }
+	footer { margin-top: 40px; color: #aaa; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Territory}}</h1>
+<div class="range">{{if .From}}{{.From}}{{else}}The beginning{{end}} to {{if .To}}{{.To}}{{else}}now{{end}} ({{.Timezone}})</div>
+
+<h2>Overview</h2>
+<div class="stats">
+	<div class="stat"><strong>{{.Total}}</strong>messages</div>
+	<div class="stat"><strong>{{.Contributors}}</strong>contributors</div>
+	{{range .Networks}}<div class="stat"><strong>{{.Count}}</strong>{{.Value}}</div>{{end}}
+</div>
+
+<h2>Messages per day</h2>
+{{if .VolumeChart.Points}}
+<svg width="{{.VolumeChart.Width}}" height="{{.VolumeChart.Height}}" viewBox="0 0 {{.VolumeChart.Width}} {{.VolumeChart.Height}}">
+	<polyline fill="none" stroke="#2a7ab0" stroke-width="2" points="{{.VolumeChart.Points}}" />
+</svg>
+<div class="range">Peak of {{.VolumeChart.Max}} messages in a day</div>
+{{else}}<p>No messages.</p>{{end}}
+
+<div class="columns">
+	<div>
+		<h2>Top hashtags</h2>
+		<table>{{range .Hashtags}}<tr><td>#{{.Value}}</td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+	</div>
+	<div>
+		<h2>Top locations</h2>
+		<table>{{range .Locations}}<tr><td>{{.Value}}</td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+	</div>
+</div>
+
+<h2>Top links</h2>
+<table>{{range .Links}}<tr><td><a href="{{.Value}}">{{.Value}}</a></td><td class="count">{{.Count}}</td></tr>{{end}}</table>
+
+<h2>Recent messages</h2>
+{{range .Messages}}
+<div class="message">
+	<div>{{.Message}}</div>
+	<div class="meta">{{.ContributorScreenName}} on {{.Network}}, {{date .Time}}</div>
+</div>
+{{end}}
+
+<footer>Generated {{date .GeneratedAt}}. Powered by Social Harvest&reg;</footer>
+</body>
+</html>
+`
@@ -19,14 +19,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
+	"errors"
 	"github.com/SocialHarvest/harvester/lib/config"
 	"github.com/advancedlogic/GoOse"
 	"github.com/ant0ine/go-json-rest/rest"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // Returns information about the currently configured database, if it's reachable, etc.
@@ -59,7 +61,11 @@ func DatabaseInfo(w rest.ResponseWriter, r *rest.Request) {
 func TerritoryAggregateData(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:aggregate")
 
-	params, fields, extraParams := buildAggregateParams(r)
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -71,7 +77,8 @@ func TerritoryAggregateData(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "aggregate", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns a simple count based on various conditions.
@@ -83,13 +90,10 @@ func TerritoryCountData(w rest.ResponseWriter, r *rest.Request) {
 	field := r.PathParam("field")
 	queryParams := r.URL.Query()
 
-	timeFrom := ""
-	if len(queryParams["from"]) > 0 {
-		timeFrom = queryParams["from"][0]
-	}
-	timeTo := ""
-	if len(queryParams["to"]) > 0 {
-		timeTo = queryParams["to"][0]
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	fieldValue := ""
 	if len(queryParams["fieldValue"]) > 0 {
@@ -129,35 +133,69 @@ func TerritoryCountData(w rest.ResponseWriter, r *rest.Request) {
 		Territory: territory,
 		Field:     field,
 		Network:   network,
-		From:      timeFrom,
-		To:        timeTo,
 		Skip:      skip,
 		Limit:     limit,
 	}
+	dr.apply(&params)
 
 	var count ResultCount
 	count = db.Count(params, fieldValue)
 	res.Data["count"] = count.Count
 	res.Data["limit"] = limit
 	res.Data["skip"] = skip
-	res.Meta.From = count.TimeFrom
-	res.Meta.To = count.TimeTo
+	dr.setMeta(res)
 
 	res.Success()
-	w.WriteJson(res.End())
+	writeResource(w, r, res, "count", func() exportTable { return countTable([]ResultCount{count}) })
+}
+
+// The top lists are all simple aggregates on a known series and field (some with extra conditions, ie. the type of link)
+type topList struct {
+	Series     string
+	Field      string
+	Conditions map[string]string
+}
+
+var topLists = map[string]topList{
+	"images":    {Series: "shared_links", Field: "expanded_url", Conditions: map[string]string{"type": " IN('photo','image')"}},
+	"videos":    {Series: "shared_links", Field: "expanded_url", Conditions: map[string]string{"type": " = 'video'"}},
+	"audio":     {Series: "shared_links", Field: "expanded_url", Conditions: map[string]string{"type": " = 'audio'"}},
+	"links":     {Series: "shared_links", Field: "expanded_url", Conditions: map[string]string{"type": " = ''"}},
+	"keywords":  {Series: "hashtags", Field: "LOWER(keyword)"},
+	"hashtags":  {Series: "hashtags", Field: "LOWER(tag)"},
+	"locations": {Series: "messages", Field: geohashPrecisionField(7)},
+}
+
+// Sets the series and extra params for a top list, returning the fields to aggregate
+func applyTopList(kind string, params *CommonQueryParams, extraParams map[string]string) []string {
+	list := topLists[kind]
+	params.Series = list.Series
+	for k, v := range list.Conditions {
+		extraParams[k] = v
+	}
+	return []string{list.Field}
+}
+
+// Locations are clustered by geohash, the precision (1-12) is the length of the geohash
+func geohashPrecisionField(precision int) string {
+	var buffer bytes.Buffer
+	buffer.WriteString("substring(contributor_geohash, 1,")
+	buffer.WriteString(strconv.Itoa(precision))
+	buffer.WriteString(")")
+	return buffer.String()
 }
 
 // Returns the top images for a given territory
 func TerritoryTopImages(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-images")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"expanded_url"}
-	// same with the series
-	params.Series = "shared_links"
-	// special params
-	extraParams["type"] = " IN('photo','image')"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("images", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -169,20 +207,21 @@ func TerritoryTopImages(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-images", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top videos for a given territory
 func TerritoryTopVideos(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-videos")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"expanded_url"}
-	// same with the series
-	params.Series = "shared_links"
-	// special params
-	extraParams["type"] = " = 'video'"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("videos", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -194,20 +233,21 @@ func TerritoryTopVideos(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-videos", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top audio for a given territory
 func TerritoryTopAudio(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-audio")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"expanded_url"}
-	// same with the series
-	params.Series = "shared_links"
-	// special params
-	extraParams["type"] = " = 'audio'"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("audio", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -219,20 +259,21 @@ func TerritoryTopAudio(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-audio", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top non video/image/audio links for a given territory
 func TerritoryTopLinks(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-links")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"expanded_url"}
-	// same with the series
-	params.Series = "shared_links"
-	// special params
-	extraParams["type"] = " = ''"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("links", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -244,18 +285,21 @@ func TerritoryTopLinks(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-links", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top keywords for a given territory (primarily a convenience route for a simple aggregate, also makes use of LOWER())
 func TerritoryTopKeywords(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-keywords")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"LOWER(keyword)"}
-	// same with the series
-	params.Series = "hashtags"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("keywords", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -267,18 +311,21 @@ func TerritoryTopKeywords(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-keywords", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top hashtags for a given territory (primarily a convenience route for a simple aggregate, also makes use of LOWER())
 func TerritoryTopHashtags(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-hashtags")
 
-	params, fields, extraParams := buildAggregateParams(r)
-	// override, we know the field we want and its just one in this case
-	fields = []string{"LOWER(tag)"}
-	// same with the series
-	params.Series = "hashtags"
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// override, we know the series and field we want (and any special params)
+	fields = applyTopList("hashtags", &params, extraParams)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -290,7 +337,8 @@ func TerritoryTopHashtags(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-hashtags", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
 // Returns the top locations for a given territory
@@ -298,10 +346,13 @@ func TerritoryTopLocations(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:top-locations")
 
 	queryParams := r.URL.Query()
-	params, fields, extraParams := buildAggregateParams(r)
+	params, fields, extraParams, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// override the fields, we know the field we want and its just one in this case ... but with an optional precision value
 	precision := 7
-	var err error
 	if len(queryParams["precision"]) > 0 {
 		precision, err = strconv.Atoi(queryParams["precision"][0])
 		if err != nil {
@@ -315,15 +366,8 @@ func TerritoryTopLocations(w rest.ResponseWriter, r *rest.Request) {
 	if precision < 1 {
 		precision = 1
 	}
-	var buffer bytes.Buffer
-	buffer.WriteString("substring(contributor_geohash, 1,")
-	buffer.WriteString(strconv.Itoa(precision))
-	buffer.WriteString(")")
-	geohash := buffer.String()
-	buffer.Reset()
-	fields = []string{geohash}
-	// same with the series
-	params.Series = "messages"
+	fields = applyTopList("locations", &params, extraParams)
+	fields[0] = geohashPrecisionField(precision)
 
 	if params.Territory != "" && params.Series != "" && len(fields) > 0 {
 		var total ResultCount
@@ -335,74 +379,139 @@ func TerritoryTopLocations(w rest.ResponseWriter, r *rest.Request) {
 		res.Data["total"] = 0
 	}
 
-	w.WriteJson(res.End())
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-locations", func() exportTable { return aggregateTable(res.Data["aggregate"]) })
 }
 
-// Returns a simple count based on various conditions in a streaming time series.
-func TerritoryTimeseriesCountData(w rest.ResponseWriter, r *rest.Request) {
-	territory := r.PathParam("territory")
-	series := r.PathParam("series")
-	field := r.PathParam("field")
-	queryParams := r.URL.Query()
+// Returns the top contributors for a given territory ranked by messages, reach (followers) or engagement (likes and shares)
+func TerritoryTopContributors(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:top-contributors")
 
-	timeFrom := ""
-	if len(queryParams["from"]) > 0 {
-		timeFrom = queryParams["from"][0]
-	}
-	timeTo := ""
-	if len(queryParams["to"]) > 0 {
-		timeTo = queryParams["to"][0]
-	}
-	fieldValue := ""
-	if len(queryParams["fieldValue"]) > 0 {
-		fieldValue = queryParams["fieldValue"][0]
+	queryParams := r.URL.Query()
+	params, _, _, dr, err := buildAggregateParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	network := ""
-	if len(queryParams["network"]) > 0 {
-		network = queryParams["network"][0]
+	params.Series = "messages"
+	if params.Limit == 0 || params.Limit > 100 {
+		params.Limit = 100
 	}
 
-	params := CommonQueryParams{
-		Series:    series,
-		Territory: territory,
-		Field:     field,
-		Network:   network,
-		From:      timeFrom,
-		To:        timeTo,
+	sortBy := "messages"
+	if len(queryParams["sort"]) > 0 {
+		if _, ok := contributorSortOrders[queryParams["sort"][0]]; ok {
+			sortBy = queryParams["sort"][0]
+		}
 	}
 
-	// in minutes
-	resolution := 0
-	if len(queryParams["resolution"]) > 0 {
-		parsedResolution, err := strconv.Atoi(queryParams["resolution"][0])
-		if err == nil {
-			resolution = parsedResolution
-		}
+	// Only the language and country conditions apply here
+	conditions := BasicConditions{}
+	if len(queryParams["lang"]) > 0 {
+		conditions.Lang = queryParams["lang"][0]
+	}
+	if len(queryParams["country"]) > 0 {
+		conditions.Country = queryParams["country"][0]
 	}
 
-	if resolution != 0 && territory != "" && series != "" {
-		// only accepting days for now - not down to minutes or hours (yet)
-		tF, _ := time.Parse("2006-01-02", timeFrom)
-		tT, _ := time.Parse("2006-01-02", timeTo)
+	contributors := []ResultContributor{}
+	if params.Territory != "" {
+		var distinct int
+		contributors, distinct = db.TopContributors(params, conditions, sortBy)
+		res.Data["contributors"] = contributors
+		res.Data["total"] = distinct
+		res.Data["sort"] = sortBy
+		res.Data["limit"] = params.Limit
+		res.Data["skip"] = params.Skip
+		res.Success()
+	} else {
+		res.Data["contributors"] = nil
+		res.Data["total"] = 0
+	}
 
-		timeRange := tT.Sub(tF)
-		//totalRangeMinutes := int(timeRange.Minutes())
-		periodsInRange := int(timeRange.Minutes() / float64(resolution))
+	dr.setMeta(res)
+	writeResource(w, r, res, "top-contributors", func() exportTable { return structsTable(contributors) })
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		var count ResultCount
-		for i := 0; i < periodsInRange; i++ {
-			params.From = tF.Format("2006-01-02 15:04:05")
-			tF = tF.Add(time.Duration(resolution) * time.Minute)
-			params.To = tF.Format("2006-01-02 15:04:05")
+// Returns a simple count based on various conditions in a streaming time series.
+func TerritoryTimeseriesCountData(w rest.ResponseWriter, r *rest.Request) {
+	params, fieldValue, dr, opts, err := buildTimeseriesParams(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			count = db.Count(params, fieldValue)
-			w.WriteJson(count)
-			w.(http.ResponseWriter).Write([]byte("\n"))
+	if !opts.Resolution.IsZero() && params.Territory != "" && params.Series != "" {
+		// JSON, CSV and TSV are streamed a line at a time, xlsx has to be written all at once at the end (as does anything downsampled)
+		format := requestedFormat(r)
+		if format == "" {
+			rest.Error(w, "Not Acceptable: this endpoint can be returned as json, csv, tsv or xlsx", http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", exportContentTypes[format])
+		if format != "json" {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+exportFilename(r, "timeseries-count", format)+`"`)
+		}
+		var cw *csv.Writer
+		if format == "csv" || format == "tsv" {
+			cw = csv.NewWriter(w.(http.ResponseWriter))
+			if format == "tsv" {
+				cw.Comma = '\t'
+			}
+			cw.Write(timeseriesTable(nil).Columns)
+		}
+		counts := []ResultTimeseriesCount{}
+
+		written := 0
+		defer func() { setAuditRows(r, written) }()
+		write := func(count ResultTimeseriesCount) {
+			written++
+			switch format {
+			case "json":
+				w.WriteJson(count)
+				w.(http.ResponseWriter).Write([]byte("\n"))
+			case "csv", "tsv":
+				cw.Write(timeseriesTable([]ResultTimeseriesCount{count}).Rows[0])
+				cw.Flush()
+			default:
+				counts = append(counts, count)
+				return
+			}
 			// Flush the buffer to client immediately
 			// (for most cases, this stream will be quick and short - just how we like it. for the more crazy requests, it may take a little while and that's ok too)
 			w.(http.Flusher).Flush()
 		}
+		each := write
+		if opts.MaxPoints > 0 {
+			// Points can only be picked once they've all been counted
+			each = func(count ResultTimeseriesCount) {
+				counts = append(counts, count)
+			}
+		}
+		if err := eachTimeseriesCount(params, fieldValue, dr, opts, each); err != nil {
+			log.Println(err)
+			// Once some of the stream has gone out the error can only be logged
+			if written == 0 {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Disposition")
+				rest.Error(w, "The timeseries couldn't be counted", http.StatusInternalServerError)
+				return
+			}
+		}
+		if opts.MaxPoints > 0 {
+			all := counts
+			counts = []ResultTimeseriesCount{}
+			for _, count := range downsampleTimeseries(all, opts.MaxPoints, opts.Downsample) {
+				write(count)
+			}
+		}
+
+		if format == "xlsx" {
+			err := writeXlsx(w.(http.ResponseWriter), timeseriesTable(counts))
+			if err != nil {
+				log.Println(err)
+			}
+		}
 	}
 
 }
@@ -414,92 +523,256 @@ func TerritoryMessages(w rest.ResponseWriter, r *rest.Request) {
 	territory := r.PathParam("territory")
 	queryParams := r.URL.Query()
 
-	timeFrom := ""
-	if len(queryParams["from"]) > 0 {
-		timeFrom = queryParams["from"][0]
-	}
-	timeTo := ""
-	if len(queryParams["to"]) > 0 {
-		timeTo = queryParams["to"][0]
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	network := ""
 	if len(queryParams["network"]) > 0 {
 		network = queryParams["network"][0]
 	}
 	// Limit and Skip
-	limit := uint64(100)
-	if len(queryParams["limit"]) > 0 {
-		l, lErr := strconv.ParseUint(queryParams["limit"][0], 10, 64)
-		if lErr == nil {
-			limit = uint64(l)
-		}
-		if limit > 100 {
-			limit = 100
-		}
-		if limit < 1 {
-			limit = 1
-		}
+	limit, skip := buildPagingParams(queryParams)
+
+	// Build the conditions
+	conditions := buildBasicConditions(queryParams)
+
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: territory,
+		Network:   network,
+		Limit:     limit,
+		Skip:      skip,
 	}
-	skip := uint64(0)
-	if len(queryParams["skip"]) > 0 {
-		sk, skErr := strconv.ParseUint(queryParams["skip"][0], 10, 64)
-		if skErr == nil {
-			skip = uint64(sk)
-		}
-		if skip < 0 {
-			skip = 0
-		}
+	dr.apply(&params)
+
+	messages, total, skip, limit := db.Messages(params, conditions)
+	res.Data["messages"] = messages
+	res.Data["total"] = total
+	res.Data["limit"] = limit
+	res.Data["skip"] = skip
+	dr.setMeta(res)
+
+	res.Success()
+	writeResource(w, r, res, "messages", func() exportTable { return structsTable(messages) })
+}
+
+// API: Returns a single message for a territory along with its related shared links, hashtags and mentions.
+func TerritoryMessage(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:message")
+
+	queryParams := r.URL.Query()
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
 	}
 
-	// Build the conditions
-	var conditions = BasicConditions{}
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: r.PathParam("territory"),
+		Network:   network,
+	}
 
-	// Condition for questions
-	if len(queryParams["questions"]) > 0 {
-		conditions.IsQuestion = 1
+	detail, found := db.MessageDetail(params, r.PathParam("message_id"))
+	if !found {
+		rest.NotFound(w, r)
+		return
 	}
-	// Gender condition
-	if len(queryParams["gender"]) > 0 {
-		conditions.Gender = queryParams["gender"][0]
+	res.Data["message"] = detail.Message
+	res.Data["shared_links"] = detail.SharedLinks
+	res.Data["hashtags"] = detail.Hashtags
+	res.Data["mentions"] = detail.Mentions
+
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// API: Returns a 7x24 matrix of message counts for a territory bucketed by day of week (0 is Sunday) and hour of day in the requested timezone.
+func TerritoryActivityHeatmap(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:activity-heatmap")
+
+	territory := r.PathParam("territory")
+	queryParams := r.URL.Query()
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	// Language condition
-	if len(queryParams["lang"]) > 0 {
-		conditions.Lang = queryParams["lang"][0]
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
 	}
-	// Country condition
-	if len(queryParams["country"]) > 0 {
-		conditions.Country = queryParams["country"][0]
+	// Optionally sum likes and shares per bucket too
+	engagement := false
+	if len(queryParams["engagement"]) > 0 {
+		engagement, _ = strconv.ParseBool(queryParams["engagement"][0])
 	}
-	// Geohash condition (nearby)
-	if len(queryParams["geohash"]) > 0 {
-		conditions.Geohash = queryParams["geohash"][0]
+
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: territory,
+		Network:   network,
+	}
+	dr.apply(&params)
+
+	heatmap := db.ActivityHeatmap(params, buildBasicConditions(queryParams), dr.Timezone(), engagement)
+	res.Data["heatmap"] = heatmap
+	res.Data["total"] = heatmap.Total
+	dr.setMeta(res)
+
+	res.Success()
+	writeResource(w, r, res, "activity-heatmap", func() exportTable { return heatmapTable(heatmap) })
+}
+
+// API: Returns the profile for a single contributor within a territory along with their message volume, top hashtags and links,
+// mention counts, latest follower stats and their most recent messages (paginated the same way as territory messages).
+func TerritoryContributor(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:contributor")
+
+	network := r.PathParam("network")
+	contributorId := r.PathParam("contributor")
+	queryParams := r.URL.Query()
+
+	territory := ""
+	if len(queryParams["territory"]) > 0 {
+		territory = queryParams["territory"][0]
+	}
+	if territory == "" {
+		rest.Error(w, "A territory is required", http.StatusBadRequest)
+		return
+	}
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	limit, skip := buildPagingParams(queryParams)
 
 	params := CommonQueryParams{
 		Series:    "messages",
 		Territory: territory,
 		Network:   network,
-		From:      timeFrom,
-		To:        timeTo,
 		Limit:     limit,
 		Skip:      skip,
 	}
+	dr.apply(&params)
 
-	messages, total, skip, limit := db.Messages(params, conditions)
+	profile := db.ContributorProfile(params, contributorId)
+	if profile.Profile == nil && profile.Growth == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	res.Data["contributor"] = profile
+
+	messages, total, skip, limit := db.Messages(params, BasicConditions{ContributorId: contributorId})
 	res.Data["messages"] = messages
 	res.Data["total"] = total
 	res.Data["limit"] = limit
 	res.Data["skip"] = skip
-	//db.Messages(params, conditions)
+	dr.setMeta(res)
 
 	res.Success()
 	w.WriteJson(res.End())
 }
 
+// API: Returns how many contributors two or more territories share (intersection, union and Jaccard index) overall and per network.
+func TerritoryOverlap(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:overlap")
+
+	queryParams := r.URL.Query()
+	territories := []string{}
+	if len(queryParams["territories"]) > 0 {
+		for _, t := range strings.Split(queryParams["territories"][0], ",") {
+			territories = append(territories, strings.Trim(t, " "))
+		}
+	}
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+
+	params := CommonQueryParams{
+		Series:  "messages",
+		Network: network,
+	}
+	dr.apply(&params)
+
+	overlap, err := db.AudienceOverlap(params, territories)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res.Data["overlap"] = overlap
+	dr.setMeta(res)
+	if len(overlap.Territories) > 1 {
+		res.Success()
+	}
+
+	writeResource(w, r, res, "overlap", func() exportTable { return overlapTable(overlap) })
+}
+
+// API: Groups a territory's contributors by the week or month of their first message and returns retention for later periods.
+func TerritoryCohorts(w rest.ResponseWriter, r *rest.Request) {
+	res := setTerritoryLinks("territory:cohorts")
+
+	territory := r.PathParam("territory")
+	queryParams := r.URL.Query()
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+	// "week" (default) or "month"
+	interval := "week"
+	if len(queryParams["interval"]) > 0 && queryParams["interval"][0] == "month" {
+		interval = "month"
+	}
+
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: territory,
+		Network:   network,
+	}
+	dr.apply(&params)
+
+	cohorts := db.Cohorts(params, interval)
+	res.Data["cohorts"] = cohorts.Cohorts
+	res.Data["periods"] = cohorts.Periods
+	res.Data["interval"] = cohorts.Interval
+	dr.setMeta(res)
+
+	res.Success()
+	writeResource(w, r, res, "cohorts", func() exportTable { return cohortsTable(cohorts) })
+}
+
 // Returns all currently configured territories and their settings
 func TerritoryList(w rest.ResponseWriter, r *rest.Request) {
 	res := setTerritoryLinks("territory:list")
-	res.Data["territories"] = socialHarvest.Config.Harvest.Territories
+	// Only the territories the API key is allowed
+	territories := socialHarvest.Config.Harvest.Territories
+	if p := requestPrincipal(r); p != nil {
+		territories = territories[:0:0]
+		for _, territory := range socialHarvest.Config.Harvest.Territories {
+			if p.hasTerritory(territory.Name) {
+				territories = append(territories, territory)
+			}
+		}
+	}
+	res.Data["territories"] = territories
 	res.Success()
 	w.WriteJson(res.End())
 }
@@ -511,40 +784,79 @@ func setTerritoryLinks(self string) *config.HypermediaResource {
 		Href: "/territory/list",
 	}
 	res.Links["territory:count"] = config.HypermediaLink{
-		Href: "/territory/count/{territory}/{series}/{field}{?from,to,network,fieldValue}",
+		Href: "/territory/count/{territory}/{series}/{field}{?from,to,tz,network,fieldValue}",
 	}
 	res.Links["territory:timeseries-count"] = config.HypermediaLink{
-		Href: "/territory/timeseries/count/{territory}/{series}/{field}{?from,to,network,fieldValue}",
+		Href: "/territory/timeseries/count/{territory}/{series}/{field}{?from,to,tz,network,fieldValue,resolution,fill,transform,window,groupBy,top,max_points,downsample}",
 	}
 	res.Links["territory:aggregate"] = config.HypermediaLink{
-		Href: "/territory/aggregate/{territory}/{series}{?from,to,network,fields}",
+		Href: "/territory/aggregate/{territory}/{series}{?from,to,tz,network,fields}",
 	}
 	res.Links["territory:timeseries-aggregate"] = config.HypermediaLink{
-		Href: "/territory/timeseries/aggregate/{territory}/{series}{?from,to,network,fields,resolution}",
+		Href: "/territory/timeseries/aggregate/{territory}/{series}{?from,to,tz,network,fields,resolution}",
 	}
 	res.Links["territory:messages"] = config.HypermediaLink{
-		Href: "/territory/messages/{territory}{?from,to,limit,skip,network,lang,country,geohash,gender,questions}",
+		Href: "/territory/messages/{territory}{?from,to,tz,limit,skip,network,lang,country,geohash,gender,questions}",
+	}
+	res.Links["territory:activity-heatmap"] = config.HypermediaLink{
+		Href: "/territory/activity/heatmap/{territory}{?from,to,tz,engagement,network,lang,country,geohash,gender,questions}",
+	}
+	res.Links["territory:export-messages"] = config.HypermediaLink{
+		Href: "/territory/export/messages/{territory}{?format,gzip,from,to,tz,network,lang,country,geohash,gender,questions}",
+	}
+	res.Links["territory:message"] = config.HypermediaLink{
+		Href: "/territory/messages/{territory}/{message_id}{?network}",
+	}
+	res.Links["territory:contributor"] = config.HypermediaLink{
+		Href: "/territory/contributor/{network}/{contributor_id}{?territory,from,to,tz,limit,skip}",
+	}
+	res.Links["territory:overlap"] = config.HypermediaLink{
+		Href: "/territory/overlap{?territories,from,to,tz,network}",
+	}
+	res.Links["territory:cohorts"] = config.HypermediaLink{
+		Href: "/territory/cohorts/{territory}{?from,to,tz,network,interval}",
+	}
+	res.Links["territory:report"] = config.HypermediaLink{
+		Href: "/territory/report/{territory}{?from,to,tz,network,format}",
+	}
+	res.Links["territory:stream"] = config.HypermediaLink{
+		Href: "/territory/stream/{territory}{?network,counts,gender,lang,country,geohash,questions}",
+	}
+	res.Links["chart:timeseries-count"] = config.HypermediaLink{
+		Href: "/chart/timeseries/count/{territory}/{series}/{field}{?from,to,tz,fieldValue,resolution,fill,transform,window,max_points,downsample,network,format,width,height}",
+	}
+	res.Links["chart:sparkline-count"] = config.HypermediaLink{
+		Href: "/chart/sparkline/count/{territory}/{series}/{field}{?from,to,tz,fieldValue,resolution,fill,transform,window,max_points,downsample,network,format,width,height}",
+	}
+	res.Links["chart:aggregate"] = config.HypermediaLink{
+		Href: "/chart/aggregate/{territory}/{series}{?fields,from,to,tz,network,limit,format,width,height}",
+	}
+	res.Links["chart:top"] = config.HypermediaLink{
+		Href: "/chart/top/{list}/{territory}{?from,to,tz,network,limit,format,width,height}",
 	}
 	res.Links["territory:top-images"] = config.HypermediaLink{
-		Href: "/territory/top/images/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/images/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-videos"] = config.HypermediaLink{
-		Href: "/territory/top/videos/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/videos/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-audio"] = config.HypermediaLink{
-		Href: "/territory/top/audio/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/audio/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-links"] = config.HypermediaLink{
-		Href: "/territory/top/links/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/links/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-locations"] = config.HypermediaLink{
-		Href: "/territory/top/locations/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/locations/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-keywords"] = config.HypermediaLink{
-		Href: "/territory/top/keywords/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/keywords/{territory}/{series}{?from,to,tz,network}",
 	}
 	res.Links["territory:top-hashtags"] = config.HypermediaLink{
-		Href: "/territory/top/hashtags/{territory}/{series}{?from,to,network}",
+		Href: "/territory/top/hashtags/{territory}/{series}{?from,to,tz,network}",
+	}
+	res.Links["territory:top-contributors"] = config.HypermediaLink{
+		Href: "/territory/top/contributors/{territory}{?from,to,tz,network,lang,country,sort,limit,skip}",
 	}
 
 	selfedRes := config.NewHypermediaResource()
@@ -591,13 +903,67 @@ func LinkDetails(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteJson(res.End())
 }
 
-func buildAggregateParams(r *rest.Request) (CommonQueryParams, []string, map[string]string) {
+// Returns the limit and skip from the querystring (limit defaults to 100, which is also the max)
+func buildPagingParams(queryParams url.Values) (uint64, uint64) {
+	limit := uint64(100)
+	if len(queryParams["limit"]) > 0 {
+		l, lErr := strconv.ParseUint(queryParams["limit"][0], 10, 64)
+		if lErr == nil {
+			limit = uint64(l)
+		}
+		if limit > 100 {
+			limit = 100
+		}
+		if limit < 1 {
+			limit = 1
+		}
+	}
+	skip := uint64(0)
+	if len(queryParams["skip"]) > 0 {
+		sk, skErr := strconv.ParseUint(queryParams["skip"][0], 10, 64)
+		if skErr == nil {
+			skip = uint64(sk)
+		}
+	}
+	return limit, skip
+}
+
+// Builds the BasicConditions from the querystring (questions, gender, lang, country, geohash)
+func buildBasicConditions(queryParams url.Values) BasicConditions {
+	var conditions = BasicConditions{}
+
+	// Condition for questions
+	if len(queryParams["questions"]) > 0 {
+		conditions.IsQuestion = 1
+	}
+	// Gender condition
+	if len(queryParams["gender"]) > 0 {
+		conditions.Gender = queryParams["gender"][0]
+	}
+	// Language condition
+	if len(queryParams["lang"]) > 0 {
+		conditions.Lang = queryParams["lang"][0]
+	}
+	// Country condition
+	if len(queryParams["country"]) > 0 {
+		conditions.Country = queryParams["country"][0]
+	}
+	// Geohash condition (nearby)
+	if len(queryParams["geohash"]) > 0 {
+		conditions.Geohash = queryParams["geohash"][0]
+	}
+
+	return conditions
+}
+
+// Returns the params for an aggregate (or top list) along with the fields, extra params and the date range.
+// An error is returned for anything the request shouldn't go ahead with (like an unknown timezone).
+func buildAggregateParams(r *rest.Request) (CommonQueryParams, []string, map[string]string, dateRange, error) {
 	territory := r.PathParam("territory")
 	series := r.PathParam("series")
 	queryParams := r.URL.Query()
 	extraParams := make(map[string]string)
 	params := CommonQueryParams{}
-	var err error
 
 	// Fields to group by
 	fields := []string{}
@@ -609,17 +975,32 @@ func buildAggregateParams(r *rest.Request) (CommonQueryParams, []string, map[str
 		}
 	}
 
-	timeFrom := ""
-	if len(queryParams["from"]) > 0 {
-		timeFrom = queryParams["from"][0]
+	// Fields go straight into the query (and could otherwise read other territories), so they must be columns of the series
+	checkColumns := SanitizeCommonQueryParams(CommonQueryParams{Series: series}).Series != ""
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		if !groupFieldPattern.MatchString(field) {
+			return params, fields, extraParams, dateRange{}, errors.New("Invalid field \"" + field + "\": fields are column names")
+		}
+		if checkColumns {
+			ok, err := db.HasColumn(series, field)
+			if err != nil {
+				log.Println(err)
+			} else if !ok {
+				return params, fields, extraParams, dateRange{}, errors.New("Invalid field \"" + field + "\": " + series + " has no such field")
+			}
+		}
 	}
-	timeTo := ""
-	if len(queryParams["to"]) > 0 {
-		timeTo = queryParams["to"][0]
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		return params, fields, extraParams, dr, err
 	}
 	network := ""
 	if len(queryParams["network"]) > 0 {
-		timeTo = queryParams["network"][0]
+		network = queryParams["network"][0]
 	}
 
 	limit := 0
@@ -639,17 +1020,16 @@ func buildAggregateParams(r *rest.Request) (CommonQueryParams, []string, map[str
 			skip = parsedSkip
 		} else {
 			log.Println("Error parsing skip param:")
-			log.Println(err)
+			log.Println(skipErr)
 		}
 	}
 
 	params.Series = series
 	params.Territory = territory
 	params.Network = network
-	params.From = timeFrom
-	params.To = timeTo
 	params.Limit = uint64(limit)
 	params.Skip = uint64(skip)
+	dr.apply(&params)
 
-	return params, fields, extraParams
+	return params, fields, extraParams, dr, nil
 }
@@ -0,0 +1,46 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildAggregateParamsFields(t *testing.T) {
+	tests := []struct {
+		fields string
+		ok     bool
+	}{
+		{"contributor_lang", true},
+		{"contributor_lang, contributor_gender", true},
+		{"", true},
+		{"contributor_lang,(SELECT contributor_id FROM messages WHERE territory='other' LIMIT 1)", false},
+		{"COUNT(*)", false},
+		{"network;DROP TABLE messages", false},
+	}
+	for _, tt := range tests {
+		r := newTestRequest(t, "http://localhost/territory/aggregate/acme/messages", "")
+		q := r.URL.Query()
+		q.Set("fields", tt.fields)
+		r.URL.RawQuery = q.Encode()
+		r.PathParams = map[string]string{"territory": "acme", "series": "messages"}
+		_, _, _, _, err := buildAggregateParams(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("fields=%s: got error %v, expected ok %v", tt.fields, err, tt.ok)
+		}
+	}
+}
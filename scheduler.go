@@ -0,0 +1,347 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the report scheduler. Jobs defined in the config are run on a cron schedule against the API routes
+// (in process, no HTTP involved), written to a directory and optionally emailed.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/robfig/cron/v3"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many runs are kept in the history for each job
+const reportRunHistory = 50
+
+type ReportRun struct {
+	Job        string    `json:"job"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Status     int       `json:"status"`
+	File       string    `json:"file,omitempty"`
+	Bytes      int       `json:"bytes"`
+	Emailed    []string  `json:"emailed,omitempty"`
+}
+
+type ReportScheduler struct {
+	conf    SchedulerConf
+	handler http.Handler
+	cron    *cron.Cron
+	entries map[string]cron.EntryID
+	mu      sync.RWMutex
+	runs    map[string][]ReportRun
+}
+
+var scheduler *ReportScheduler
+
+// Sets up the scheduler with the jobs from the config. Reports are run against the given handler, which should have the API routes
+// but none of the auth middleware (the jobs come from the config, so they're trusted).
+func newReportScheduler(conf SchedulerConf, handler http.Handler) (*ReportScheduler, error) {
+	s := &ReportScheduler{
+		conf:    conf,
+		handler: handler,
+		cron:    cron.New(),
+		entries: map[string]cron.EntryID{},
+		runs:    map[string][]ReportRun{},
+	}
+	if s.conf.Directory == "" {
+		s.conf.Directory = "reports"
+	}
+
+	for _, job := range conf.Jobs {
+		if job.Name == "" || job.Endpoint == "" {
+			return nil, errors.New("scheduled reports need a name and an endpoint")
+		}
+		if _, ok := s.entries[job.Name]; ok {
+			return nil, errors.New("scheduled report names must be unique: " + job.Name)
+		}
+		j := job
+		id, err := s.cron.AddFunc(job.Schedule, func() { s.Run(j) })
+		if err != nil {
+			return nil, errors.New("invalid schedule for report " + job.Name + ": " + err.Error())
+		}
+		s.entries[job.Name] = id
+		s.runs[job.Name] = []ReportRun{}
+	}
+	return s, nil
+}
+
+func (s *ReportScheduler) Start() {
+	s.cron.Start()
+}
+
+func (s *ReportScheduler) Stop() {
+	s.cron.Stop()
+}
+
+// Runs a report job now, writes the file and emails it if configured. The run is recorded in the job's history.
+func (s *ReportScheduler) Run(job ReportJob) ReportRun {
+	run := ReportRun{Job: job.Name, StartedAt: time.Now().UTC()}
+
+	body, status, filename, contentType, err := s.render(job, run.StartedAt)
+	run.Status = status
+	run.Bytes = len(body)
+	if err == nil {
+		run.File, err = s.write(filename, body)
+	}
+	if err == nil && len(job.Email) > 0 {
+		err = s.email(job, filepath.Base(run.File), contentType, body)
+		if err == nil {
+			run.Emailed = job.Email
+		}
+	}
+
+	run.FinishedAt = time.Now().UTC()
+	run.Success = err == nil
+	if err != nil {
+		run.Error = err.Error()
+		log.Println("Scheduled report " + job.Name + " failed: " + run.Error)
+	}
+
+	s.mu.Lock()
+	runs := append(s.runs[job.Name], run)
+	if len(runs) > reportRunHistory {
+		runs = runs[len(runs)-reportRunHistory:]
+	}
+	s.runs[job.Name] = runs
+	s.mu.Unlock()
+
+	return run
+}
+
+// Runs the report's request through the API handler, returning the body, status, filename and content type
+func (s *ReportScheduler) render(job ReportJob, now time.Time) ([]byte, int, string, string, error) {
+	params := url.Values{}
+	for k, v := range job.Params {
+		params.Set(k, v)
+	}
+	format := job.Format
+	if format == "" {
+		format = "json"
+	}
+	params.Set("format", format)
+
+	req, err := http.NewRequest("GET", job.Endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, 0, "", "", err
+	}
+	rec := newResponseRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if rec.status != http.StatusOK {
+		return rec.body.Bytes(), rec.status, "", "", errors.New("report returned status " + strconv.Itoa(rec.status) + ": " + strings.TrimSpace(rec.body.String()))
+	}
+
+	// Use the name the endpoint gave the file (if any), prefixed with the job and the time it ran so runs don't overwrite each other
+	filename := ""
+	if _, dispositionParams, err := mime.ParseMediaType(rec.header.Get("Content-Disposition")); err == nil {
+		filename = dispositionParams["filename"]
+	}
+	if filename == "" {
+		filename = "report." + format
+	}
+	r, _ := regexp.Compile(`[^A-Za-z0-9\-\.]+`)
+	filename = r.ReplaceAllString(job.Name, "-") + "_" + now.Format("20060102T150405Z") + "_" + filename
+
+	return rec.body.Bytes(), rec.status, filename, rec.header.Get("Content-Type"), nil
+}
+
+func (s *ReportScheduler) write(filename string, body []byte) (string, error) {
+	err := os.MkdirAll(s.conf.Directory, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.conf.Directory, filename)
+	return path, ioutil.WriteFile(path, body, 0644)
+}
+
+// Emails the report as an attachment through the configured SMTP server
+func (s *ReportScheduler) email(job ReportJob, filename string, contentType string, body []byte) error {
+	if s.conf.Smtp.Host == "" {
+		return errors.New("report " + job.Name + " has email recipients but no SMTP server is configured")
+	}
+	port := s.conf.Smtp.Port
+	if port == 0 {
+		port = 25
+	}
+	subject := job.Subject
+	if subject == "" {
+		subject = "Social Harvest report: " + job.Name
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	boundary := "socialharvest-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	var msg bytes.Buffer
+	msg.WriteString("From: " + s.conf.Smtp.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(job.Email, ", ") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n\r\n")
+	msg.WriteString("--" + boundary + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString("The \"" + job.Name + "\" report is attached (" + filename + ").\r\n\r\n")
+	msg.WriteString("--" + boundary + "\r\n")
+	msg.WriteString("Content-Type: " + contentType + "\r\n")
+	msg.WriteString("Content-Transfer-Encoding: base64\r\n")
+	msg.WriteString("Content-Disposition: attachment; filename=\"" + filename + "\"\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	msg.WriteString("--" + boundary + "--\r\n")
+
+	var auth smtp.Auth
+	if s.conf.Smtp.Username != "" {
+		auth = smtp.PlainAuth("", s.conf.Smtp.Username, s.conf.Smtp.Password, s.conf.Smtp.Host)
+	}
+	return smtp.SendMail(s.conf.Smtp.Host+":"+strconv.Itoa(port), auth, s.conf.Smtp.From, job.Email, msg.Bytes())
+}
+
+// Returns the job definitions along with their next and last runs
+func (s *ReportScheduler) Jobs() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := []map[string]interface{}{}
+	for _, job := range s.conf.Jobs {
+		j := map[string]interface{}{
+			"name":     job.Name,
+			"schedule": job.Schedule,
+			"endpoint": job.Endpoint,
+			"params":   job.Params,
+			"format":   job.Format,
+			"email":    job.Email,
+			"next":     s.cron.Entry(s.entries[job.Name]).Next,
+			"lastRun":  nil,
+		}
+		if runs := s.runs[job.Name]; len(runs) > 0 {
+			j["lastRun"] = runs[len(runs)-1]
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// Returns the run history for a job (most recent first) and whether or not the job exists
+func (s *ReportScheduler) Runs(name string) ([]ReportRun, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	runs, ok := s.runs[name]
+	if !ok {
+		return nil, false
+	}
+	history := make([]ReportRun, len(runs))
+	for i, run := range runs {
+		history[len(runs)-1-i] = run
+	}
+	return history, true
+}
+
+// A bare bones http.ResponseWriter that keeps the response in memory (the reports are run in process)
+type responseRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	return rr.body.Write(b)
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+}
+
+// Some endpoints stream and expect to be able to flush
+func (rr *responseRecorder) Flush() {
+}
+
+// --------- API end points ---------
+
+// Returns the scheduled report jobs with their next and last runs
+func ReportJobs(w rest.ResponseWriter, r *rest.Request) {
+	res := setReportLinks("reports:jobs")
+	if scheduler != nil {
+		res.Data["jobs"] = scheduler.Jobs()
+	} else {
+		res.Data["jobs"] = []map[string]interface{}{}
+	}
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+// Returns the run history for a scheduled report job
+func ReportJobRuns(w rest.ResponseWriter, r *rest.Request) {
+	res := setReportLinks("reports:job-runs")
+	if scheduler == nil {
+		rest.NotFound(w, r)
+		return
+	}
+	runs, ok := scheduler.Runs(r.PathParam("name"))
+	if !ok {
+		rest.NotFound(w, r)
+		return
+	}
+	res.Data["runs"] = runs
+	res.Success()
+	w.WriteJson(res.End())
+}
+
+func setReportLinks(self string) *config.HypermediaResource {
+	res := config.NewHypermediaResource()
+	links := map[string]config.HypermediaLink{
+		"reports:jobs":     {Href: "/reports/jobs"},
+		"reports:job-runs": {Href: "/reports/jobs/{name}/runs"},
+	}
+	for link, l := range links {
+		if link == self {
+			res.Links["self"] = l
+		} else {
+			res.Links[link] = l
+		}
+	}
+	return res
+}
@@ -0,0 +1,430 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the live message stream. Newly harvested messages for a territory are pushed to the client
+// over Server-Sent Events or, if the client asks to upgrade, a WebSocket.
+package main
+
+import (
+	"encoding/json"
+	"github.com/SocialHarvest/harvester/lib/config"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A comment is sent on otherwise quiet SSE streams (and a ping on WebSockets) this often so proxies don't close the connection
+const streamKeepAlive = 15 * time.Second
+
+// Running counts of what's been sent on a stream (sent with ?counts=true)
+type StreamCounts struct {
+	Total    int            `json:"total"`
+	Networks map[string]int `json:"networks"`
+	Since    time.Time      `json:"since"`
+}
+
+// Where a stream is up to: the time, network and id of a message, the same order messages are read in (see EachMessages)
+type streamCursor struct {
+	Time      time.Time
+	Network   string
+	MessageId string
+}
+
+func messageCursor(message config.SocialHarvestMessage) streamCursor {
+	return streamCursor{Time: message.Time, Network: message.Network, MessageId: message.MessageId}
+}
+
+func (c streamCursor) after(other streamCursor) bool {
+	if !c.Time.Equal(other.Time) {
+		return c.Time.After(other.Time)
+	}
+	if c.Network != other.Network {
+		return c.Network > other.Network
+	}
+	return c.MessageId > other.MessageId
+}
+
+// The SSE event id: nanoseconds:network:message id (ids can contain colons, so it's last)
+func (c streamCursor) String() string {
+	return strconv.FormatInt(c.Time.UnixNano(), 10) + ":" + c.Network + ":" + c.MessageId
+}
+
+// Reads a Last-Event-ID, false if it isn't one of ours
+func parseStreamCursor(id string) (streamCursor, bool) {
+	parts := strings.SplitN(id, ":", 3)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return streamCursor{}, false
+	}
+	c := streamCursor{Time: time.Unix(0, nanos).UTC()}
+	if len(parts) == 3 {
+		c.Network = parts[1]
+		c.MessageId = parts[2]
+	}
+	return c, true
+}
+
+// Tracks what a stream has sent so far
+type messageStream struct {
+	params   CommonQueryParams
+	conds    BasicConditions
+	lookback time.Duration
+	// Messages at or before this are never sent (the stream started or the client reconnected there)
+	start streamCursor
+	// The newest message time sent
+	newest time.Time
+	// What's been sent within the lookback, so it isn't sent again
+	sent   map[string]time.Time
+	counts StreamCounts
+}
+
+func newMessageStream(params CommonQueryParams, conds BasicConditions, lookback time.Duration, start streamCursor) *messageStream {
+	return &messageStream{
+		params:   params,
+		conds:    conds,
+		lookback: lookback,
+		start:    start,
+		newest:   start.Time,
+		sent:     map[string]time.Time{},
+		counts:   StreamCounts{Networks: map[string]int{}, Since: time.Now().UTC()},
+	}
+}
+
+// Passes each message that hasn't been sent yet to fn (oldest first) as the batches are read. An error from fn stops the poll
+// and is returned.
+func (s *messageStream) poll(fn func(config.SocialHarvestMessage) error) error {
+	from := s.newest.Add(-s.lookback)
+	params := s.params
+	params.From = from.Format("2006-01-02 15:04:05")
+
+	err := db.EachMessages(params, s.conds, func(batch []config.SocialHarvestMessage) error {
+		for _, message := range batch {
+			key := message.Network + "|" + message.MessageId
+			if _, ok := s.sent[key]; ok || !messageCursor(message).after(s.start) {
+				continue
+			}
+			s.sent[key] = message.Time
+			if message.Time.After(s.newest) {
+				s.newest = message.Time
+			}
+			s.counts.Total++
+			s.counts.Networks[message.Network]++
+			if err := fn(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Forget what's fallen out of the lookback
+	for key, t := range s.sent {
+		if t.Before(from) {
+			delete(s.sent, key)
+		}
+	}
+	return err
+}
+
+// Wakes up streams when Postgres sends a notification (see StreamConf)
+type streamNotifier struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+var streamNotifications = &streamNotifier{subs: map[chan struct{}]struct{}{}}
+
+func (n *streamNotifier) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	n.subs[ch] = struct{}{}
+	n.mu.Unlock()
+	return ch
+}
+
+func (n *streamNotifier) unsubscribe(ch chan struct{}) {
+	n.mu.Lock()
+	delete(n.subs, ch)
+	n.mu.Unlock()
+}
+
+func (n *streamNotifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		// A stream that's already been woken up doesn't need to be told twice
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// LISTENs on the configured channel and wakes up the streams on each notification (the payload isn't used)
+func listenForMessages(c config.SocialHarvestConf, channel string) (*pq.Listener, error) {
+	listener := pq.NewListener(postgresConnString(c), time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println(err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for range listener.Notify {
+			// A nil notification means the connection was re-established, polling then catches up on anything missed
+			streamNotifications.broadcast()
+		}
+	}()
+	return listener, nil
+}
+
+// Limits how many streams can be open at once
+var streamClients = struct {
+	sync.Mutex
+	open int
+}{}
+
+func streamSettings() (time.Duration, time.Duration, time.Duration, int) {
+	conf := reporterConfig.ReporterServer.Stream
+	pollInterval, err := time.ParseDuration(conf.PollInterval)
+	if err != nil || pollInterval < 100*time.Millisecond {
+		pollInterval = 2 * time.Second
+	}
+	lookback, err := time.ParseDuration(conf.Lookback)
+	if err != nil || lookback < 0 {
+		lookback = time.Minute
+	}
+	resume, err := time.ParseDuration(conf.Resume)
+	if err != nil || resume < 0 {
+		resume = 5 * time.Minute
+	}
+	maxClients := conf.MaxClients
+	if maxClients <= 0 {
+		maxClients = 100
+	}
+	return pollInterval, lookback, resume, maxClients
+}
+
+// Sends messages (and optionally counts) as they come in until the client goes away or send fails.
+// send is given the event type ("message" or "counts"), an id and the data. ping keeps the connection alive.
+func runMessageStream(s *messageStream, withCounts bool, pollInterval time.Duration, done <-chan struct{}, send func(string, string, interface{}) error, ping func() error) {
+	wake := streamNotifications.subscribe()
+	defer streamNotifications.unsubscribe(wake)
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-keepAlive.C:
+			if ping() != nil {
+				return
+			}
+			continue
+		case <-wake:
+		case <-poll.C:
+		}
+
+		// Messages go out as each batch is read rather than all at once
+		var sendErr error
+		sent := 0
+		err := s.poll(func(message config.SocialHarvestMessage) error {
+			// The id lets SSE clients pick up where they left off (Last-Event-ID) when they reconnect
+			sendErr = send("message", messageCursor(message).String(), message)
+			sent++
+			return sendErr
+		})
+		if sendErr != nil {
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if withCounts && sent > 0 {
+			if send("counts", "", s.counts) != nil {
+				return
+			}
+		}
+	}
+}
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// Same origin requests are fine, otherwise the origin needs to be allowed for CORS
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host {
+			return true
+		}
+		for _, allowedOrigin := range socialHarvest.Config.ReporterServer.Cors.AllowedOrigins {
+			if origin == allowedOrigin {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// --------- API end points ---------
+
+// Streams new messages for a territory as they're harvested. Takes the same filters as the messages endpoint.
+// Server-Sent Events by default, or a WebSocket if the request asks to upgrade. With ?counts=true running counts are sent too.
+func TerritoryMessageStream(w rest.ResponseWriter, r *rest.Request) {
+	if db.Postgres == nil {
+		rest.Error(w, "Streaming needs a Postgres database", http.StatusNotImplemented)
+		return
+	}
+	pollInterval, lookback, resume, maxClients := streamSettings()
+
+	queryParams := r.URL.Query()
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+	withCounts := len(queryParams["counts"]) > 0 && queryParams["counts"][0] == "true"
+	params := CommonQueryParams{
+		Series:    "messages",
+		Territory: r.PathParam("territory"),
+		Network:   network,
+	}
+
+	// Start from now, unless an SSE client is reconnecting and said what it saw last. It can't go back further than the resume
+	// window though (the id comes from the client, and going back too far would mean reading a whole territory's history).
+	now := time.Now().UTC()
+	start := streamCursor{Time: now}
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		if c, ok := parseStreamCursor(lastEventId); ok && c.Time.Before(now) {
+			start = c
+			if start.Time.Before(now.Add(-resume)) {
+				start = streamCursor{Time: now.Add(-resume)}
+			}
+		}
+	}
+	s := newMessageStream(params, buildBasicConditions(queryParams), lookback, start)
+
+	streamClients.Lock()
+	if streamClients.open >= maxClients {
+		streamClients.Unlock()
+		w.Header().Set("Retry-After", "30")
+		rest.Error(w, "Too many open streams, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	streamClients.open++
+	streamClients.Unlock()
+	defer func() {
+		streamClients.Lock()
+		streamClients.open--
+		streamClients.Unlock()
+	}()
+
+	// What was sent over the life of the stream
+	defer func() { setAuditRows(r, s.counts.Total) }()
+	if websocket.IsWebSocketUpgrade(r.Request) {
+		streamWebSocket(w, r, s, withCounts, pollInterval)
+	} else {
+		streamEvents(w, r, s, withCounts, pollInterval)
+	}
+}
+
+func streamEvents(w rest.ResponseWriter, r *rest.Request, s *messageStream, withCounts bool, pollInterval time.Duration) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Nginx buffers responses by default, which defeats the purpose
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	out := w.(http.ResponseWriter)
+	flusher := w.(http.Flusher)
+	// Tell the browser how long to wait before reconnecting
+	out.Write([]byte("retry: " + strconv.FormatInt(int64(pollInterval/time.Millisecond), 10) + "\n\n"))
+	flusher.Flush()
+
+	done := make(chan struct{})
+	closed := w.(http.CloseNotifier).CloseNotify()
+	go func() {
+		<-closed
+		close(done)
+	}()
+
+	send := func(event string, id string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var frame []string
+		frame = append(frame, "event: "+event)
+		if id != "" {
+			frame = append(frame, "id: "+id)
+		}
+		frame = append(frame, "data: "+string(data))
+		if _, err = out.Write([]byte(strings.Join(frame, "\n") + "\n\n")); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		_, err := out.Write([]byte(": ping\n\n"))
+		flusher.Flush()
+		return err
+	}
+	runMessageStream(s, withCounts, pollInterval, done, send, ping)
+}
+
+// WebSocket frames are JSON: {"type": "message", "data": {...}} or {"type": "counts", "data": {...}}
+func streamWebSocket(w rest.ResponseWriter, r *rest.Request, s *messageStream, withCounts bool, pollInterval time.Duration) {
+	conn, err := streamUpgrader.Upgrade(w.(http.ResponseWriter), r.Request, nil)
+	if err != nil {
+		// The upgrader has already responded
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	// Nothing is expected from the client, but reading is how a close (or a dead connection) gets noticed
+	done := make(chan struct{})
+	conn.SetReadLimit(512)
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event string, id string, v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(map[string]interface{}{"type": event, "data": v})
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	}
+	runMessageStream(s, withCounts, pollInterval, done, send, ping)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
@@ -0,0 +1,56 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamCursor(t *testing.T) {
+	at := time.Date(2014, 10, 1, 12, 0, 0, 0, time.UTC)
+	c := streamCursor{Time: at, Network: "twitter", MessageId: "abc:123"}
+	parsed, ok := parseStreamCursor(c.String())
+	if !ok || !parsed.Time.Equal(c.Time) || parsed.Network != c.Network || parsed.MessageId != c.MessageId {
+		t.Fatalf("parseStreamCursor(%q) = %+v, %v", c.String(), parsed, ok)
+	}
+	// Plain nanoseconds (ids sent before the network and message id were added)
+	if parsed, ok := parseStreamCursor("1412164800000000000"); !ok || !parsed.Time.Equal(at) || parsed.MessageId != "" {
+		t.Errorf("parseStreamCursor(nanoseconds) = %+v, %v", parsed, ok)
+	}
+	if _, ok := parseStreamCursor("nope"); ok {
+		t.Error("parseStreamCursor accepted a bad id")
+	}
+
+	// Messages at the same time as the cursor are only skipped up to and including the one it points at
+	tests := []struct {
+		other streamCursor
+		want  bool
+	}{
+		{streamCursor{Time: at, Network: "twitter", MessageId: "abc:123"}, false},
+		{streamCursor{Time: at, Network: "twitter", MessageId: "abc:124"}, true},
+		{streamCursor{Time: at, Network: "facebook", MessageId: "zzz"}, false},
+		{streamCursor{Time: at, Network: "youtube", MessageId: "aaa"}, true},
+		{streamCursor{Time: at.Add(time.Nanosecond)}, true},
+		{streamCursor{Time: at.Add(-time.Second), Network: "youtube", MessageId: "zzz"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.other.after(c); got != tt.want {
+			t.Errorf("%+v.after(%+v) = %v, want %v", tt.other, c, got, tt.want)
+		}
+	}
+}
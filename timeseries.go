@@ -0,0 +1,480 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// This file contains the building of timeseries: the resolution (how long each period is), the fill policy for
+// periods without any data and the walking of the periods in a date range.
+//
+// Resolutions are named (1m, 15m, 1h, 1d, 1w, 1M for a month) or a number of minutes as before (1440 is a day).
+// Periods start at the from date and are in the range's timezone. A period that's cut short by the to date is
+// still returned and flagged as partial.
+//
+// A transform (moving averages, running totals, etc.) can also be applied to the counts as they're walked. The
+// transformed value is returned alongside the count, which is never changed.
+package main
+
+import (
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Keeps a mistaken resolution (a minute over a few years) from streaming out millions of periods
+const maxTimeseriesPeriods = 10000
+
+// Downsampled timeseries only send max_points, so they can be counted at a finer resolution (a year at 15 minutes, or
+// even 5 minutes, is fine). They're held in memory to be downsampled though, so there's still a limit.
+const maxDownsampledPeriods = 110000
+
+var resolutionPattern = regexp.MustCompile(`^([0-9]+)(m|h|d|w|M)$`)
+
+const resolutionHelp = "use a number of minutes (60) or a named resolution (1m, 15m, 1h, 1d, 1w or 1M for a month)"
+
+// How long each period in a timeseries is. Days and months are calendar days and months in the range's timezone.
+type timeseriesResolution struct {
+	Minutes int
+	Days    int
+	Months  int
+}
+
+// What empty periods are given
+const (
+	fillZero     = "zero"
+	fillNull     = "null"
+	fillPrevious = "previous"
+)
+
+// The transforms that can be applied to a timeseries
+const (
+	transformSMA     = "sma"
+	transformEMA     = "ema"
+	transformCumsum  = "cumsum"
+	transformRate    = "rate"
+	transformPercent = "percent"
+)
+
+const transformHelp = "use sma, ema (both with a window), cumsum, rate or percent"
+
+// The largest moving average window
+const maxTransformWindow = 1000
+
+type timeseriesOptions struct {
+	Resolution timeseriesResolution
+	Fill       string
+	Transform  string
+	// The number of periods in a moving average
+	Window int
+	// For several series at once, the field they're grouped by and either the values wanted or how many of the top values
+	GroupBy string
+	Values  []string
+	Top     int
+	// Downsampling for drawing (see downsample.go), 0 for every period
+	MaxPoints  int
+	Downsample string
+}
+
+// How many of the top values are returned by default and at most when grouping
+const (
+	defaultTimeseriesTop = 5
+	maxTimeseriesTop     = 50
+)
+
+// Whether the timeseries has several series (see eachTimeseriesCount)
+func (opts timeseriesOptions) grouped() bool {
+	return opts.GroupBy != ""
+}
+
+// Reads a resolution, an empty value is no resolution (and so no timeseries)
+func parseResolution(value string) (timeseriesResolution, error) {
+	res := timeseriesResolution{}
+	if value == "" {
+		return res, nil
+	}
+	// Minutes, as it always has been
+	if minutes, err := strconv.Atoi(value); err == nil {
+		if minutes <= 0 {
+			return res, errors.New(resolutionHelp)
+		}
+		if minutes%1440 == 0 {
+			res.Days = minutes / 1440
+		} else {
+			res.Minutes = minutes
+		}
+		return res, nil
+	}
+
+	matches := resolutionPattern.FindStringSubmatch(value)
+	if matches == nil {
+		return res, errors.New(resolutionHelp)
+	}
+	n, err := strconv.Atoi(matches[1])
+	if err != nil || n <= 0 || n > 100000 {
+		return res, errors.New(resolutionHelp)
+	}
+	switch matches[2] {
+	case "m":
+		res.Minutes = n
+	case "h":
+		res.Minutes = n * 60
+	case "d":
+		res.Days = n
+	case "w":
+		res.Days = n * 7
+	case "M":
+		res.Months = n
+	}
+	return res, nil
+}
+
+func (res timeseriesResolution) IsZero() bool {
+	return res.Minutes == 0 && res.Days == 0 && res.Months == 0
+}
+
+// The start of the next period. Days and months use the calendar, so a day is still a day across daylight saving changes.
+func (res timeseriesResolution) next(t time.Time) time.Time {
+	if res.Months > 0 {
+		return t.AddDate(0, res.Months, 0)
+	}
+	if res.Days > 0 {
+		return t.AddDate(0, 0, res.Days)
+	}
+	return t.Add(time.Duration(res.Minutes) * time.Minute)
+}
+
+// Returns the params for a timeseries (count) along with the fieldValue, the range and the options (resolution and fill).
+// An error (which should be returned to the client as a 400) means a param couldn't be read.
+func buildTimeseriesParams(r *rest.Request) (CommonQueryParams, string, dateRange, timeseriesOptions, error) {
+	queryParams := r.URL.Query()
+	opts := timeseriesOptions{Fill: fillZero}
+
+	dr, err := buildDateRange(queryParams)
+	if err != nil {
+		return CommonQueryParams{}, "", dr, opts, err
+	}
+	fieldValue := ""
+	if len(queryParams["fieldValue"]) > 0 {
+		fieldValue = queryParams["fieldValue"][0]
+	}
+	network := ""
+	if len(queryParams["network"]) > 0 {
+		network = queryParams["network"][0]
+	}
+
+	params := CommonQueryParams{
+		Series:    r.PathParam("series"),
+		Territory: r.PathParam("territory"),
+		Field:     r.PathParam("field"),
+		Network:   network,
+	}
+	dr.apply(&params)
+
+	if len(queryParams["resolution"]) > 0 {
+		opts.Resolution, err = parseResolution(queryParams["resolution"][0])
+		if err != nil {
+			return params, fieldValue, dr, opts, errors.New("Invalid resolution \"" + queryParams["resolution"][0] + "\": " + err.Error())
+		}
+	}
+	if len(queryParams["fill"]) > 0 && queryParams["fill"][0] != "" {
+		switch queryParams["fill"][0] {
+		case fillZero, fillNull, fillPrevious:
+			opts.Fill = queryParams["fill"][0]
+		default:
+			return params, fieldValue, dr, opts, errors.New("Invalid fill \"" + queryParams["fill"][0] + "\": use zero, null or previous")
+		}
+	}
+
+	if len(queryParams["transform"]) > 0 && queryParams["transform"][0] != "" {
+		opts.Transform = queryParams["transform"][0]
+		switch opts.Transform {
+		case transformSMA, transformEMA:
+			window := ""
+			if len(queryParams["window"]) > 0 {
+				window = queryParams["window"][0]
+			}
+			opts.Window, err = strconv.Atoi(window)
+			if err != nil || opts.Window < 1 || opts.Window > maxTransformWindow {
+				return params, fieldValue, dr, opts, errors.New("Invalid window \"" + window + "\": a moving average needs a window of 1 to " + strconv.Itoa(maxTransformWindow) + " periods")
+			}
+		case transformCumsum, transformRate, transformPercent:
+		default:
+			return params, fieldValue, dr, opts, errors.New("Invalid transform \"" + opts.Transform + "\": " + transformHelp)
+		}
+	}
+
+	// Several fieldValue or network values, or a groupBy field, ask for a series per value
+	grouping := 0
+	if len(queryParams["fieldValue"]) > 1 {
+		grouping++
+		if params.Field == "" {
+			return params, fieldValue, dr, opts, errors.New("Several fieldValue values need a field")
+		}
+		opts.GroupBy = params.Field
+		opts.Values = queryParams["fieldValue"]
+		fieldValue = ""
+	}
+	if len(queryParams["network"]) > 1 {
+		grouping++
+		opts.GroupBy = "network"
+		opts.Values = queryParams["network"]
+		params.Network = ""
+	}
+	if len(queryParams["groupBy"]) > 0 && queryParams["groupBy"][0] != "" {
+		grouping++
+		opts.GroupBy = queryParams["groupBy"][0]
+		if !groupFieldPattern.MatchString(opts.GroupBy) {
+			return params, fieldValue, dr, opts, errors.New("Invalid groupBy \"" + opts.GroupBy + "\": it must be a field name")
+		}
+		opts.Top = defaultTimeseriesTop
+		if len(queryParams["top"]) > 0 {
+			opts.Top, err = strconv.Atoi(queryParams["top"][0])
+			if err != nil || opts.Top < 1 || opts.Top > maxTimeseriesTop {
+				return params, fieldValue, dr, opts, errors.New("Invalid top \"" + queryParams["top"][0] + "\": use 1 to " + strconv.Itoa(maxTimeseriesTop))
+			}
+		}
+	}
+	if grouping > 1 {
+		return params, fieldValue, dr, opts, errors.New("Use only one of several fieldValue values, several network values or groupBy")
+	}
+	// The grouped results are streamed, so a bad column has to be caught before anything is written
+	if opts.grouped() {
+		ok, err := db.HasColumn(params.Series, opts.GroupBy)
+		if err != nil {
+			log.Println(err)
+		} else if !ok {
+			return params, fieldValue, dr, opts, errors.New("Invalid groupBy \"" + opts.GroupBy + "\": " + params.Series + " has no such field")
+		}
+	}
+
+	if len(queryParams["max_points"]) > 0 && queryParams["max_points"][0] != "" {
+		opts.MaxPoints, err = strconv.Atoi(queryParams["max_points"][0])
+		if err != nil || opts.MaxPoints < minDownsamplePoints {
+			return params, fieldValue, dr, opts, errors.New("Invalid max_points \"" + queryParams["max_points"][0] + "\": use " + strconv.Itoa(minDownsamplePoints) + " or more")
+		}
+		opts.Downsample = downsampleLTTB
+		if len(queryParams["downsample"]) > 0 && queryParams["downsample"][0] != "" {
+			opts.Downsample = queryParams["downsample"][0]
+			if opts.Downsample != downsampleLTTB && opts.Downsample != downsampleMinMax {
+				return params, fieldValue, dr, opts, errors.New("Invalid downsample \"" + opts.Downsample + "\": use lttb or minmax")
+			}
+		}
+	}
+
+	maxPeriods := maxTimeseriesPeriods
+	if opts.MaxPoints > 0 {
+		// Every series is held at once
+		series := 1
+		if len(opts.Values) > 0 {
+			series = len(opts.Values)
+		} else if opts.Top > 0 {
+			series = opts.Top
+		}
+		maxPeriods = maxDownsampledPeriods / series
+	}
+	if len(timeseriesPeriods(dr, opts.Resolution)) > maxPeriods {
+		return params, fieldValue, dr, opts, errors.New("Too many periods: the range and resolution give more than " + strconv.Itoa(maxPeriods) + ", use a larger resolution, a shorter range or max_points")
+	}
+
+	return params, fieldValue, dr, opts, nil
+}
+
+// Applies a transform to each count in turn. Null counts (see fill) are skipped and their value is null too.
+type timeseriesTransformer struct {
+	kind   string
+	window int
+	// The total for the whole range (percent)
+	total int
+	// What's been seen so far
+	recent   []float64
+	sum      float64
+	ema      float64
+	seen     int
+	previous *float64
+}
+
+func newTimeseriesTransformer(opts timeseriesOptions, total int) *timeseriesTransformer {
+	return &timeseriesTransformer{kind: opts.Transform, window: opts.Window, total: total}
+}
+
+func (t *timeseriesTransformer) next(count *int) *float64 {
+	if count == nil {
+		return nil
+	}
+	v := float64(*count)
+	var value float64
+	t.seen++
+
+	switch t.kind {
+	case transformSMA:
+		// A simple moving average is null until there's a full window
+		t.recent = append(t.recent, v)
+		t.sum += v
+		if len(t.recent) > t.window {
+			t.sum -= t.recent[0]
+			t.recent = t.recent[1:]
+		}
+		if len(t.recent) < t.window {
+			return nil
+		}
+		value = t.sum / float64(t.window)
+	case transformEMA:
+		// An exponential moving average starts at the first count
+		if t.seen == 1 {
+			t.ema = v
+		} else {
+			alpha := 2 / (float64(t.window) + 1)
+			t.ema = alpha*v + (1-alpha)*t.ema
+		}
+		value = t.ema
+	case transformCumsum:
+		t.sum += v
+		value = t.sum
+	case transformRate:
+		// The change from the previous period, null for the first
+		previous := t.previous
+		t.previous = &v
+		if previous == nil {
+			return nil
+		}
+		value = v - *previous
+	case transformPercent:
+		if t.total == 0 {
+			return nil
+		}
+		value = v / float64(t.total) * 100
+	default:
+		return nil
+	}
+	return &value
+}
+
+// A period in a timeseries
+type timeseriesPeriod struct {
+	From    time.Time
+	To      time.Time
+	Partial bool
+}
+
+// Returns the periods of the resolution in the range. The last period is cut off at the to date (and flagged as partial)
+// when the resolution doesn't divide the range evenly.
+func timeseriesPeriods(dr dateRange, res timeseriesResolution) []timeseriesPeriod {
+	periods := []timeseriesPeriod{}
+	if dr.from.IsZero() || dr.to.IsZero() || res.IsZero() {
+		return periods
+	}
+	for tF := dr.from; tF.Before(dr.to) && len(periods) <= maxDownsampledPeriods; tF = res.next(tF) {
+		period := timeseriesPeriod{From: tF, To: res.next(tF)}
+		if period.To.After(dr.to) {
+			period.To = dr.to
+			period.Partial = true
+		}
+		periods = append(periods, period)
+	}
+	return periods
+}
+
+// Fills and transforms the counts of one series in turn
+type timeseriesFiller struct {
+	opts        timeseriesOptions
+	previous    *int
+	transformer *timeseriesTransformer
+}
+
+func newTimeseriesFiller(opts timeseriesOptions, total int) *timeseriesFiller {
+	f := &timeseriesFiller{opts: opts}
+	if opts.Transform != "" {
+		f.transformer = newTimeseriesTransformer(opts, total)
+	}
+	return f
+}
+
+func (f *timeseriesFiller) result(period timeseriesPeriod, dr dateRange, count int) ResultTimeseriesCount {
+	result := ResultTimeseriesCount{
+		Count:    &count,
+		TimeFrom: period.From.Format(dbTimeFormat),
+		TimeTo:   period.To.Format(dbTimeFormat),
+		Timezone: dr.Timezone(),
+		Partial:  period.Partial,
+	}
+	if count == 0 {
+		switch f.opts.Fill {
+		case fillNull:
+			result.Count = nil
+		case fillPrevious:
+			result.Count = f.previous
+		}
+	}
+	f.previous = result.Count
+	if f.transformer != nil {
+		result.Transform = f.opts.Transform
+		result.Value = f.transformer.next(result.Count)
+	}
+	return result
+}
+
+// Calls fn with the count for each period of the resolution in the range (for each series, see timeseriesOptions.GroupBy,
+// all of a period's series before the next period). Empty periods are filled as asked. It's one query no matter how many
+// series or periods there are and the periods are streamed as they're read, except for percent of total which needs
+// every series' total first.
+func eachTimeseriesCount(params CommonQueryParams, fieldValue string, dr dateRange, opts timeseriesOptions, fn func(ResultTimeseriesCount)) error {
+	periods := timeseriesPeriods(dr, opts.Resolution)
+	if len(periods) == 0 {
+		return nil
+	}
+	boundaries := []time.Time{}
+	for _, period := range periods {
+		boundaries = append(boundaries, period.From)
+	}
+	boundaries = append(boundaries, periods[len(periods)-1].To)
+
+	fillers := map[string]*timeseriesFiller{}
+	emit := func(count ResultGroupedCount) {
+		filler, ok := fillers[count.Value]
+		if !ok {
+			filler = newTimeseriesFiller(opts, 0)
+			fillers[count.Value] = filler
+		}
+		result := filler.result(periods[count.Bucket-1], dr, count.Count)
+		result.Series = count.Value
+		fn(result)
+	}
+
+	if opts.Transform != transformPercent {
+		return db.EachGroupedCount(params, fieldValue, opts.GroupBy, opts.Values, opts.Top, boundaries, func(count ResultGroupedCount) error {
+			emit(count)
+			return nil
+		})
+	}
+
+	counts := []ResultGroupedCount{}
+	totals := map[string]int{}
+	err := db.EachGroupedCount(params, fieldValue, opts.GroupBy, opts.Values, opts.Top, boundaries, func(count ResultGroupedCount) error {
+		counts = append(counts, count)
+		totals[count.Value] += count.Count
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for value, total := range totals {
+		fillers[value] = newTimeseriesFiller(opts, total)
+	}
+	for _, count := range counts {
+		emit(count)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Social Harvest is a social media analytics platform.
+//     Copyright (C) 2014 Tom Maiaroto, Shift8Creative, LLC (http://www.socialharvest.io)
+//
+//     This program is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     This program is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseResolution(t *testing.T) {
+	tests := []struct {
+		value string
+		want  timeseriesResolution
+	}{
+		{"", timeseriesResolution{}},
+		{"60", timeseriesResolution{Minutes: 60}},
+		{"90", timeseriesResolution{Minutes: 90}},
+		{"1440", timeseriesResolution{Days: 1}},
+		{"10080", timeseriesResolution{Days: 7}},
+		{"1m", timeseriesResolution{Minutes: 1}},
+		{"15m", timeseriesResolution{Minutes: 15}},
+		{"1h", timeseriesResolution{Minutes: 60}},
+		{"6h", timeseriesResolution{Minutes: 360}},
+		{"1d", timeseriesResolution{Days: 1}},
+		{"2w", timeseriesResolution{Days: 14}},
+		{"1M", timeseriesResolution{Months: 1}},
+		{"3M", timeseriesResolution{Months: 3}},
+	}
+	for _, tt := range tests {
+		got, err := parseResolution(tt.value)
+		if err != nil {
+			t.Errorf("parseResolution(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseResolution(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"0", "-5", "0m", "1y", "1s", "h", "1.5h", "1 h", "1000000d"} {
+		if got, err := parseResolution(value); err == nil {
+			t.Errorf("parseResolution(%q) = %+v, want an error", value, got)
+		}
+	}
+}
+
+func TestTimeseriesPeriods(t *testing.T) {
+	at := func(loc *time.Location, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2014, month, day, hour, minute, 0, 0, loc)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+
+	type period struct {
+		from, to time.Time
+		partial  bool
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		res      timeseriesResolution
+		want     []period
+	}{
+		{"even", at(time.UTC, 10, 1, 9, 30), at(time.UTC, 10, 1, 10, 30), timeseriesResolution{Minutes: 15}, []period{
+			{at(time.UTC, 10, 1, 9, 30), at(time.UTC, 10, 1, 9, 45), false},
+			{at(time.UTC, 10, 1, 9, 45), at(time.UTC, 10, 1, 10, 0), false},
+			{at(time.UTC, 10, 1, 10, 0), at(time.UTC, 10, 1, 10, 15), false},
+			{at(time.UTC, 10, 1, 10, 15), at(time.UTC, 10, 1, 10, 30), false},
+		}},
+		{"partial", at(time.UTC, 10, 1, 0, 0), at(time.UTC, 10, 1, 2, 30), timeseriesResolution{Minutes: 60}, []period{
+			{at(time.UTC, 10, 1, 0, 0), at(time.UTC, 10, 1, 1, 0), false},
+			{at(time.UTC, 10, 1, 1, 0), at(time.UTC, 10, 1, 2, 0), false},
+			{at(time.UTC, 10, 1, 2, 0), at(time.UTC, 10, 1, 2, 30), true},
+		}},
+		{"shorter than one period", at(time.UTC, 10, 1, 0, 0), at(time.UTC, 10, 1, 0, 10), timeseriesResolution{Days: 1}, []period{
+			{at(time.UTC, 10, 1, 0, 0), at(time.UTC, 10, 1, 0, 10), true},
+		}},
+		{"months", at(time.UTC, 1, 1, 0, 0), at(time.UTC, 4, 1, 0, 0), timeseriesResolution{Months: 1}, []period{
+			{at(time.UTC, 1, 1, 0, 0), at(time.UTC, 2, 1, 0, 0), false},
+			{at(time.UTC, 2, 1, 0, 0), at(time.UTC, 3, 1, 0, 0), false},
+			{at(time.UTC, 3, 1, 0, 0), at(time.UTC, 4, 1, 0, 0), false},
+		}},
+		// Days are calendar days in the range's timezone, so the day clocks go back is 25 hours long
+		{"days over a DST change", at(newYork, 11, 1, 0, 0), at(newYork, 11, 4, 0, 0), timeseriesResolution{Days: 1}, []period{
+			{at(newYork, 11, 1, 0, 0), at(newYork, 11, 2, 0, 0), false},
+			{at(newYork, 11, 2, 0, 0), at(newYork, 11, 3, 0, 0), false},
+			{at(newYork, 11, 3, 0, 0), at(newYork, 11, 4, 0, 0), false},
+		}},
+		{"no resolution", at(time.UTC, 10, 1, 0, 0), at(time.UTC, 10, 2, 0, 0), timeseriesResolution{}, []period{}},
+		{"backwards", at(time.UTC, 10, 2, 0, 0), at(time.UTC, 10, 1, 0, 0), timeseriesResolution{Minutes: 60}, []period{}},
+	}
+	for _, tt := range tests {
+		got := timeseriesPeriods(dateRange{from: tt.from, to: tt.to, Location: tt.from.Location()}, tt.res)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d periods, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, p := range got {
+			w := tt.want[i]
+			if !p.From.Equal(w.from) || !p.To.Equal(w.to) || p.Partial != w.partial {
+				t.Errorf("%s: period %d is %s to %s (partial %v), want %s to %s (partial %v)", tt.name, i, p.From, p.To, p.Partial, w.from, w.to, w.partial)
+			}
+		}
+	}
+	if hours := timeseriesPeriods(dateRange{from: at(newYork, 11, 2, 0, 0), to: at(newYork, 11, 3, 0, 0)}, timeseriesResolution{Minutes: 60}); len(hours) != 25 {
+		t.Errorf("got %d hourly periods on the day clocks went back, want 25", len(hours))
+	}
+
+	// A year at 15 minutes is too many to stream, but not to downsample
+	year := dateRange{from: at(time.UTC, 1, 1, 0, 0), to: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	n := len(timeseriesPeriods(year, timeseriesResolution{Minutes: 15}))
+	if n != 365*96 || n <= maxTimeseriesPeriods || n > maxDownsampledPeriods {
+		t.Errorf("got %d periods for a year at 15 minutes", n)
+	}
+}